@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// ClientInput client attributes accepted by the administration API
+type ClientInput struct {
+	ID                                 *string             `json:"client_id"`
+	RedirectURIs                       database.StringList `json:"redirect_uris"`
+	PostLogoutRedirectURIs             database.StringList `json:"post_logout_redirect_uris"`
+	GrantTypes                         database.StringList `json:"grant_types"`
+	Scopes                             database.StringList `json:"scopes"`
+	AccessTokenLifetime                *int                `json:"access_token_lifetime"`
+	RefreshTokenLifetime               *int                `json:"refresh_token_lifetime"`
+	RequirePKCE                        *bool               `json:"require_pkce"`
+	PKCES256Only                       *bool               `json:"pkce_s256_only"`
+	RequirePushedAuthorizationRequests *bool               `json:"require_pushed_authorization_requests"`
+	RequestURIs                        database.StringList `json:"request_uris"`
+	ResponseTypes                      database.StringList `json:"response_types"`
+	TokenEndpointAuthMethod            *string             `json:"token_endpoint_auth_method"`
+	JWKS                               database.JSONMap    `json:"jwks"`
+	JWKSURI                            *string             `json:"jwks_uri"`
+	TLSClientAuthSubjectDN             *string             `json:"tls_client_auth_subject_dn"`
+	TLSClientCertificateThumbprint     *string             `json:"tls_client_certificate_thumbprint"`
+	Metadata                           database.JSONMap    `json:"metadata"`
+	// Public clients are created without secret
+	Public bool `json:"public"`
+}
+
+// apply copies attributes present in the input to the client
+func (i *ClientInput) apply(c *Client) {
+	if i.RedirectURIs != nil {
+		c.RedirectURIs = i.RedirectURIs
+	}
+	if i.PostLogoutRedirectURIs != nil {
+		c.PostLogoutRedirectURIs = i.PostLogoutRedirectURIs
+	}
+	if i.GrantTypes != nil {
+		c.GrantTypes = i.GrantTypes
+	}
+	if i.Scopes != nil {
+		c.Scopes = i.Scopes
+	}
+	if i.AccessTokenLifetime != nil {
+		c.AccessTokenLifetime = *i.AccessTokenLifetime
+	}
+	if i.RefreshTokenLifetime != nil {
+		c.RefreshTokenLifetime = *i.RefreshTokenLifetime
+	}
+	if i.RequirePKCE != nil {
+		c.RequirePKCE = *i.RequirePKCE
+	}
+	if i.PKCES256Only != nil {
+		c.PKCES256Only = *i.PKCES256Only
+	}
+	if i.RequirePushedAuthorizationRequests != nil {
+		c.RequirePushedAuthorizationRequests = *i.RequirePushedAuthorizationRequests
+	}
+	if i.RequestURIs != nil {
+		c.RequestURIs = i.RequestURIs
+	}
+	if i.ResponseTypes != nil {
+		c.ResponseTypes = i.ResponseTypes
+	}
+	if i.TokenEndpointAuthMethod != nil {
+		c.TokenEndpointAuthMethod = *i.TokenEndpointAuthMethod
+	}
+	if i.JWKS != nil {
+		c.JWKS = i.JWKS
+	}
+	if i.JWKSURI != nil {
+		c.JWKSURI = *i.JWKSURI
+	}
+	if i.TLSClientAuthSubjectDN != nil {
+		c.TLSClientAuthSubjectDN = *i.TLSClientAuthSubjectDN
+	}
+	if i.TLSClientCertificateThumbprint != nil {
+		c.TLSClientCertificateThumbprint = *i.TLSClientCertificateThumbprint
+	}
+	if i.Metadata != nil {
+		c.Metadata = i.Metadata
+	}
+}
+
+// ClientResponse client with the plain secret, which is returned only when it is generated
+type ClientResponse struct {
+	*Client
+	Secret string `json:"client_secret,omitempty"`
+}
+
+// adminAuth requires token with the admin scope or ADMIN_SECRET as bearer token
+func adminAuth(srv *server.Server, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, scheme, ok := accessTokenFromRequest(r, srv)
+		if !ok {
+			writeBearerError(w, http.StatusUnauthorized, "", "")
+			return
+		}
+
+		if secret := os.Getenv("ADMIN_SECRET"); secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+			next(w, r)
+			return
+		}
+
+		ti, err := srv.Manager.LoadAccessToken(token)
+		if err == nil {
+			err = verifyTokenBinding(r, ti, scheme)
+		}
+		if err != nil {
+			writeBearerError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+			return
+		}
+		scope := getAdminScope()
+		cli, _ := srv.Manager.GetClient(ti.GetClientID())
+		if !containsScope(ti.GetScope(), scope) || !adminScopeAllowed(cli, ti.GetUserID()) {
+			writeBearerError(w, http.StatusForbidden, "insufficient_scope", "The access token was not granted the admin scope", scope)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func getAdminScope() string {
+	if scope := os.Getenv("ADMIN_SCOPE"); scope != "" {
+		return scope
+	}
+	return "admin"
+}
+
+// adminScopeAllowed checks the client lists the admin scope and the user is one of ADMIN_USERS,
+// so neither clients with unrestricted scopes nor any signed in user get it
+func adminScopeAllowed(cli oauth2.ClientInfo, userID string) bool {
+	client, ok := cli.(*Client)
+	if !ok || !client.Scopes.Contains(getAdminScope()) {
+		return false
+	}
+	return userID == "" || database.StringList(strings.Split(os.Getenv("ADMIN_USERS"), ",")).Contains(userID)
+}
+
+// adminClientsHandler serves
+//
+//	GET, POST /admin/clients
+//	GET, PUT, DELETE /admin/clients/{id}
+//	POST /admin/clients/{id}/secret, /admin/clients/{id}/disable, /admin/clients/{id}/enable
+//
+// deleted and disabled clients lose their tokens, resource servers which only verify the JWT signature
+// accept the access tokens until they expire
+func adminClientsHandler(clients *ClientStore, db *database.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/clients"), "/")
+		if path == "" {
+			switch r.Method {
+			case http.MethodGet:
+				list, err := clients.List()
+				if err != nil {
+					writeJSONError(w, http.StatusInternalServerError, err)
+					return
+				}
+				writeJSON(w, http.StatusOK, list)
+			case http.MethodPost:
+				createClient(w, r, clients)
+			default:
+				writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			}
+			return
+		}
+
+		parts := strings.Split(path, "/")
+		client, err := clients.Get(parts[0])
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if client == nil {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("client %s not found", parts[0]))
+			return
+		}
+
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, ClientResponse{Client: client})
+		case action == "" && r.Method == http.MethodPut:
+			updateClient(w, r, clients, client)
+		case action == "" && r.Method == http.MethodDelete:
+			err := clients.Delete(client.ID)
+			if err == nil {
+				err = removeClientTokens(db, client.ID)
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case action == "secret" && r.Method == http.MethodPost:
+			secret, err := generateSecret()
+			if err == nil {
+				err = client.SetSecret(secret)
+			}
+			if err == nil {
+				err = clients.Update(client)
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, ClientResponse{Client: client, Secret: secret})
+		case (action == "disable" || action == "enable") && r.Method == http.MethodPost:
+			client.Disabled = action == "disable"
+			err := clients.Update(client)
+			if err == nil && client.Disabled {
+				err = removeClientTokens(db, client.ID)
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, ClientResponse{Client: client})
+		default:
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("%s %s not found", r.Method, r.URL.Path))
+		}
+	}
+}
+
+// adminInitialAccessTokensHandler POST /admin/initial_access_tokens mints tokens for the client registration
+func adminInitialAccessTokensHandler(tokens *InitialAccessTokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		var input struct {
+			ExpiresIn int `json:"expires_in"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		token, t, err := tokens.Create(time.Second * time.Duration(input.ExpiresIn))
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"initial_access_token": token,
+			"expires_at":           t.ExpiresAt,
+		})
+	}
+}
+
+func createClient(w http.ResponseWriter, r *http.Request, clients *ClientStore) {
+	var input ClientInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	client := &Client{ID: uuid.New().String()}
+	if input.ID != nil && *input.ID != "" {
+		client.ID = *input.ID
+	}
+	input.apply(client)
+	if err := validateRedirectURIs(client.RedirectURIs); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateRedirectURIs(client.PostLogoutRedirectURIs); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	existing, err := clients.Get(client.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if existing != nil {
+		writeJSONError(w, http.StatusConflict, fmt.Errorf("client %s already exists", client.ID))
+		return
+	}
+
+	secret := ""
+	if !input.Public {
+		if secret, err = generateSecret(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := client.SetSecret(secret); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := clients.Create(client); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, ClientResponse{Client: client, Secret: secret})
+}
+
+func updateClient(w http.ResponseWriter, r *http.Request, clients *ClientStore, client *Client) {
+	var input ClientInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if input.ID != nil && *input.ID != client.ID {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("client_id can not be changed"))
+		return
+	}
+
+	input.apply(client)
+	if err := validateRedirectURIs(client.RedirectURIs); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateRedirectURIs(client.PostLogoutRedirectURIs); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := clients.Update(client); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ClientResponse{Client: client})
+}
+
+// validateRedirectURIs requires absolute URIs without fragment
+// https://tools.ietf.org/html/rfc6749#section-3.1.2
+func validateRedirectURIs(uris []string) error {
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			return fmt.Errorf("invalid redirect uri %s", uri)
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, statusCode int, err error) {
+	writeJSON(w, statusCode, map[string]string{"error": err.Error()})
+}
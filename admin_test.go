@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/graphql-services/oauth/database"
+	oauth2gorm "github.com/techknowlogick/go-oauth2-gorm"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/models"
+	"gopkg.in/oauth2.v3/server"
+	"gopkg.in/oauth2.v3/store"
+)
+
+func TestClientAllowsAdminScope(t *testing.T) {
+	unrestricted := &Client{ID: "unrestricted"}
+	admin := &Client{ID: "admin", Scopes: database.StringList{"openid", "admin"}}
+
+	if !unrestricted.AllowsScope("openid profile custom") {
+		t.Errorf("empty scopes should allow any scope")
+	}
+	if unrestricted.AllowsScope("openid admin") {
+		t.Errorf("empty scopes should not allow the admin scope")
+	}
+	if !admin.AllowsScope("admin") {
+		t.Errorf("listed admin scope should be allowed")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	os.Setenv("ADMIN_USERS", "u1")
+	defer os.Unsetenv("ADMIN_USERS")
+	defer useTestSigningKey(t)()
+
+	db := database.NewDBWithString("sqlite3://:memory:")
+	clients := ClientStore{DB: db}
+	if err := clients.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	for _, cli := range []*Client{{ID: "unrestricted"}, {ID: "admin", Scopes: database.StringList{"admin"}}} {
+		if err := clients.Create(cli); err != nil {
+			t.Fatalf("[%v] Failed to create client", err)
+		}
+	}
+
+	m := manage.NewDefaultManager()
+	m.MapClientStorage(&clients)
+	tokens, _ := store.NewMemoryTokenStore()
+	m.MapTokenStorage(tokens)
+	srv := server.NewDefaultServer(m)
+	handler := adminAuth(srv, func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := []struct {
+		name       string
+		clientID   string
+		userID     string
+		statusCode int
+	}{
+		{"unrestricted client credentials", "unrestricted", "", http.StatusForbidden},
+		{"unrestricted client password grant", "unrestricted", "u1", http.StatusForbidden},
+		{"password grant of other user", "admin", "u2", http.StatusForbidden},
+		{"client credentials", "admin", "", http.StatusOK},
+		{"password grant of admin user", "admin", "u1", http.StatusOK},
+	}
+	for _, c := range cases {
+		access := createTestAccessToken(t, tokens, &models.Token{ClientID: c.clientID, UserID: c.userID, Scope: "admin"}, nil)
+		r := httptest.NewRequest("GET", "/admin/clients", nil)
+		r.Header.Set("Authorization", "Bearer "+access)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.statusCode {
+			t.Errorf("[%s] expected %d, got %d", c.name, c.statusCode, w.Code)
+		}
+	}
+
+	// stored token which is not a JWT has no claims to check its binding
+	err := tokens.Create(&models.Token{ClientID: "admin", Scope: "admin", Access: "opaque", AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatalf("[%v] Failed to store token", err)
+	}
+	r := httptest.NewRequest("GET", "/admin/clients", nil)
+	r.Header.Set("Authorization", "Bearer opaque")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("token without claims should be refused, got %d", w.Code)
+	}
+}
+
+func TestAdminClientsHandlerRemovesTokens(t *testing.T) {
+	db := database.NewDBWithString("sqlite3://:memory:")
+	clients := ClientStore{DB: db}
+	if err := clients.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	tokens := oauth2gorm.NewStoreWithDB(&oauth2gorm.Config{TableName: tokenTableName}, db.Client(), 1800)
+	handler := adminClientsHandler(&clients, db)
+
+	cases := []struct {
+		method string
+		action string
+	}{
+		{"POST", "/disable"},
+		{"DELETE", ""},
+	}
+	for _, c := range cases {
+		for _, id := range []string{"app", "other"} {
+			if err := clients.Update(&Client{ID: id}); err != nil {
+				t.Fatalf("[%v] Failed to create client", err)
+			}
+			err := tokens.Create(&models.Token{
+				ClientID:        id,
+				UserID:          "u1",
+				Access:          c.method + "-" + id,
+				AccessCreateAt:  time.Now(),
+				AccessExpiresIn: time.Hour,
+			})
+			if err != nil {
+				t.Fatalf("[%v] Failed to store token", err)
+			}
+		}
+
+		r := httptest.NewRequest(c.method, "/admin/clients/app"+c.action, nil)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code >= 300 {
+			t.Fatalf("[%s %s] expected success, got %d", c.method, c.action, w.Code)
+		}
+		if ti, _ := tokens.GetByAccess(c.method + "-app"); ti != nil {
+			t.Errorf("[%s %s] tokens of the client should be removed", c.method, c.action)
+		}
+		if ti, _ := tokens.GetByAccess(c.method + "-other"); ti == nil {
+			t.Errorf("[%s %s] tokens of other clients should be kept", c.method, c.action)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// AuthorizationCodeRequest parameters of the authorization request needed when the code is exchanged
+type AuthorizationCodeRequest struct {
+	Code                string `gorm:"primary_key;type:varchar(512)"`
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// Nonce, AuthTime and SessionID go to the ID token issued for the code
+	Nonce     string
+	AuthTime  int64
+	SessionID string
+	CreatedAt time.Time
+}
+
+type AuthorizationCodeStore struct {
+	DB *database.DB
+}
+
+func (s *AuthorizationCodeStore) AutoMigrate() error {
+	return s.DB.AutoMigrate(&AuthorizationCodeRequest{})
+}
+
+func (s *AuthorizationCodeStore) Create(req *AuthorizationCodeRequest) error {
+	// codes which were never exchanged are dropped here instead of a separate gc
+	expired := time.Now().Add(-manage.DefaultCodeExp)
+	if err := s.DB.Client().Where("created_at < ?", expired).Delete(&AuthorizationCodeRequest{}).Error; err != nil {
+		return err
+	}
+	return s.DB.Client().Create(req).Error
+}
+
+func (s *AuthorizationCodeStore) Get(code string) (req *AuthorizationCodeRequest, err error) {
+	var r AuthorizationCodeRequest
+	res := s.DB.Client().First(&r, &AuthorizationCodeRequest{Code: code})
+	if res.RecordNotFound() {
+		return
+	}
+	err = res.Error
+	if err != nil {
+		return
+	}
+	req = &r
+	return
+}
+
+func (s *AuthorizationCodeStore) Delete(code string) error {
+	return s.DB.Client().Delete(&AuthorizationCodeRequest{Code: code}).Error
+}
+
+// AuthorizeGenerate generates the authorization code and stores the request parameters bound to it
+type AuthorizeGenerate struct {
+	oauth2.AuthorizeGenerate
+	Codes *AuthorizationCodeStore
+}
+
+// Token generates the code with the wrapped generator
+func (g *AuthorizeGenerate) Token(data *oauth2.GenerateBasic) (code string, err error) {
+	code, err = g.AuthorizeGenerate.Token(data)
+	if err != nil {
+		return
+	}
+
+	req := &AuthorizationCodeRequest{Code: code}
+	if auth := authenticationFromRequest(data.Request); auth != nil {
+		req.Nonce, req.AuthTime, req.SessionID = auth.Nonce, auth.AuthTime, auth.SessionID
+	}
+	if challenge := data.Request.FormValue("code_challenge"); challenge != "" {
+		req.CodeChallenge = challenge
+		req.CodeChallengeMethod = data.Request.FormValue("code_challenge_method")
+		if req.CodeChallengeMethod == "" {
+			req.CodeChallengeMethod = PKCEMethodPlain
+		}
+	}
+	err = g.Codes.Create(req)
+	return
+}
+
+// validateRedirectURI requires exact match with one of the registered redirect URIs,
+// the manager passes them from Client.GetDomain separated by space
+func validateRedirectURI(baseURI, redirectURI string) error {
+	for _, uri := range strings.Fields(baseURI) {
+		if uri == redirectURI {
+			return nil
+		}
+	}
+	return errors.ErrInvalidRedirectURI
+}
+
+func authorizeHandler(srv *server.Server, pars *PushedAuthorizationRequestStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := resolvePushedRequest(r, srv, pars)
+		if err == nil {
+			err = resolveRequestObject(r, srv)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateAuthorizeRequest(r, srv); err != nil {
+			if rerr := redirectAuthorizeError(w, r, srv, err); rerr != nil {
+				http.Error(w, rerr.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+
+		if err := srv.HandleAuthorizeRequest(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// validateAuthorizeRequest checks the parameters the server library does not know about
+func validateAuthorizeRequest(r *http.Request, srv *server.Server) error {
+	cli, err := srv.Manager.GetClient(r.FormValue("client_id"))
+	if err != nil {
+		return err
+	}
+	client, _ := cli.(*Client)
+
+	// unverified redirect_uri must not be used even for error redirects
+	redirectURI := r.FormValue("redirect_uri")
+	if redirectURI == "" && client != nil && len(client.RedirectURIs) == 1 {
+		r.Form.Set("redirect_uri", client.RedirectURIs[0])
+	} else if err := validateRedirectURI(cli.GetDomain(), redirectURI); err != nil {
+		return err
+	}
+
+	if err := validatePrompt(r); err != nil {
+		return err
+	}
+
+	rt := oauth2.ResponseType(r.FormValue("response_type"))
+	if client != nil && !client.AllowsResponseType(rt) {
+		return errors.ErrUnauthorizedClient
+	}
+	// scopes the client can not get are refused before the user is asked to consent to them
+	if client != nil && !client.AllowsScope(r.FormValue("scope")) {
+		return errors.ErrInvalidScope
+	}
+	if rt == oauth2.Code {
+		return validateCodeChallenge(client, r.FormValue("code_challenge"), r.FormValue("code_challenge_method"))
+	}
+	return nil
+}
+
+// redirectAuthorizeError sends the error to the redirect_uri once it is verified to belong to the client,
+// errors about the client or its redirect_uri are returned to be shown to the user
+func redirectAuthorizeError(w http.ResponseWriter, r *http.Request, srv *server.Server, err error) error {
+	if err == errors.ErrInvalidRedirectURI {
+		return err
+	}
+	req, verr := srv.ValidationAuthorizeRequest(r)
+	if verr != nil {
+		return verr
+	}
+	cli, verr := srv.Manager.GetClient(req.ClientID)
+	if verr != nil {
+		return verr
+	}
+	if req.RedirectURI == "" {
+		// without redirect_uri only the single registered URI is unambiguous
+		uris := strings.Fields(cli.GetDomain())
+		if len(uris) != 1 {
+			return err
+		}
+		req.RedirectURI = uris[0]
+	} else if verr := validateRedirectURI(cli.GetDomain(), req.RedirectURI); verr != nil {
+		return verr
+	}
+
+	data, _, _ := srv.GetErrorData(err)
+	uri, verr := srv.GetRedirectURI(req, data)
+	if verr != nil {
+		return verr
+	}
+	w.Header().Set("Location", uri)
+	w.WriteHeader(http.StatusFound)
+	return nil
+}
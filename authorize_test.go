@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/server"
+)
+
+func TestAuthorizeHandlerErrors(t *testing.T) {
+	db := database.NewDBWithString("sqlite3://:memory:")
+	clients := ClientStore{DB: db}
+	if err := clients.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	for _, cli := range []*Client{
+		{ID: "single", RedirectURIs: database.StringList{"https://single.example.com/cb"}, Scopes: database.StringList{"openid"}},
+		{ID: "multiple", RedirectURIs: database.StringList{"https://a.example.com/cb", "https://b.example.com/cb"}, Scopes: database.StringList{"openid"}},
+	} {
+		if err := clients.Create(cli); err != nil {
+			t.Fatalf("[%v] Failed to create client", err)
+		}
+	}
+	m := manage.NewDefaultManager()
+	m.MapClientStorage(&clients)
+	handler := authorizeHandler(server.NewDefaultServer(m), nil)
+
+	cases := []struct {
+		name        string
+		clientID    string
+		redirectURI string
+		location    string
+	}{
+		{"single registered uri", "single", "", "https://single.example.com/cb"},
+		{"registered uri", "multiple", "https://b.example.com/cb", "https://b.example.com/cb"},
+		{"ambiguous registered uris", "multiple", "", ""},
+		{"unregistered uri", "single", "https://evil.example.com/cb", ""},
+		{"unknown client", "unknown", "https://evil.example.com/cb", ""},
+	}
+	for _, c := range cases {
+		q := url.Values{"client_id": {c.clientID}, "response_type": {"code"}, "scope": {"admin"}, "state": {"xyz"}}
+		if c.redirectURI != "" {
+			q.Set("redirect_uri", c.redirectURI)
+		}
+		r := httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil)
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		location := w.Header().Get("Location")
+		if c.location == "" {
+			if w.Code != http.StatusBadRequest || location != "" {
+				t.Errorf("[%s] error should be shown instead of redirected, got %d %s", c.name, w.Code, location)
+			}
+			continue
+		}
+		if w.Code != http.StatusFound || !strings.HasPrefix(location, c.location+"?") || !strings.Contains(location, "error=invalid_scope") {
+			t.Errorf("[%s] expected redirect to %s, got %d %s", c.name, c.location, w.Code, location)
+		}
+	}
+}
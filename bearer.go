@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// writeBearerError responds with the WWW-Authenticate challenge
+// https://tools.ietf.org/html/rfc6750#section-3
+func writeBearerError(w http.ResponseWriter, statusCode int, code, description string, scope ...string) {
+	params := []string{`realm="oauth"`}
+	if code != "" {
+		params = append(params, fmt.Sprintf(`error="%s"`, code))
+	}
+	if description != "" {
+		params = append(params, fmt.Sprintf(`error_description="%s"`, strings.Replace(description, `"`, `'`, -1)))
+	}
+	if len(scope) > 0 {
+		params = append(params, fmt.Sprintf(`scope="%s"`, strings.Join(scope, " ")))
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer "+strings.Join(params, ", "))
+	w.WriteHeader(statusCode)
+}
+
+// validateBearerToken loads the access token of the request, the error response is written when it is missing or invalid
+func validateBearerToken(w http.ResponseWriter, r *http.Request, srv *server.Server) (ti oauth2.TokenInfo, ok bool) {
+	token, scheme, present := accessTokenFromRequest(r, srv)
+	if !present {
+		writeBearerError(w, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	ti, err := srv.Manager.LoadAccessToken(token)
+	if err == nil {
+		err = verifyTokenBinding(r, ti, scheme)
+	}
+	if err != nil {
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	}
+	ok = true
+	return
+}
+
+// accessTokenFromRequest returns the access token of the Authorization header with its scheme, Bearer or DPoP
+// https://datatracker.ietf.org/doc/html/rfc9449#section-7.1
+func accessTokenFromRequest(r *http.Request, srv *server.Server) (token, scheme string, ok bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "DPoP ") {
+		return strings.TrimPrefix(auth, "DPoP "), "DPoP", true
+	}
+	token, ok = srv.BearerAuth(r)
+	return token, "Bearer", ok
+}
+
+// verifyTokenBinding checks sender constrained access token is used by its holder,
+// certificate bound tokens over TLS with the same certificate and DPoP bound tokens with proof of the same key
+// https://tools.ietf.org/html/rfc8705#section-3 https://datatracker.ietf.org/doc/html/rfc9449#section-7
+func verifyTokenBinding(r *http.Request, ti oauth2.TokenInfo, scheme string) error {
+	// tokens which are not issued by the generator could skip the binding, so they are refused
+	claims, err := accessTokenClaims(ti)
+	if err != nil {
+		return fmt.Errorf("the access token can not be decoded")
+	}
+	cnf := claims.Confirmation
+	if cnf == nil {
+		cnf = &ConfirmationClaim{}
+	}
+
+	if cnf.X5TS256 != "" {
+		cert := clientCertificate(r)
+		if cert == nil || certificateThumbprint(cert) != cnf.X5TS256 {
+			return fmt.Errorf("the access token is bound to another certificate")
+		}
+	}
+	if (cnf.JKT != "") != (scheme == "DPoP") {
+		return fmt.Errorf("DPoP bound access tokens have to be used with the DPoP scheme")
+	}
+	if cnf.JKT != "" {
+		jkt, err := verifyDPoPProof(r, ti.GetAccess(), false)
+		if err != nil || jkt != cnf.JKT {
+			return fmt.Errorf("the DPoP proof is invalid or of another key")
+		}
+	}
+	return nil
+}
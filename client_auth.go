@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graphql-services/oauth/database"
+	"github.com/lestrrat/go-jwx/jwk"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// clientAssertionType https://tools.ietf.org/html/rfc7523#section-2.2
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionSigningAlgs accepted for client assertions, HS* are used by client_secret_jwt and the others by private_key_jwt
+var clientAssertionSigningAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "HS256", "HS384", "HS512"}
+
+// publicClientEndpoints accept public clients without credentials (method none), the other endpoints
+// reveal or revoke tokens of the client, so a known client_id is not enough there
+var publicClientEndpoints = database.StringList{"/token", "/device_authorization", "/par"}
+
+// clientAssertions records jti of the client assertions, it is set up in main
+var clientAssertions *AssertionStore
+
+// authenticateClient authenticates the calling client with HTTP Basic, form posted credentials, client assertion
+// or client certificate, public clients only at publicClientEndpoints
+// https://tools.ietf.org/html/rfc6749#section-2.3.1
+func authenticateClient(r *http.Request, manager oauth2.Manager) (client *Client, err error) {
+	if r.FormValue("client_assertion_type") != "" || r.FormValue("client_assertion") != "" {
+		if client, err = authenticateClientAssertion(r, manager); err != nil {
+			log.Println("Invalid client assertion:", err)
+			client, err = nil, errors.ErrInvalidClient
+		}
+		return
+	}
+
+	method := "client_secret_basic"
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+		method = "client_secret_post"
+	}
+	if clientSecret == "" {
+		method = "none"
+	}
+	if clientID == "" {
+		err = errors.ErrInvalidClient
+		return
+	}
+
+	cli, err := manager.GetClient(clientID)
+	if err != nil {
+		err = errors.ErrInvalidClient
+		return
+	}
+	client, ok = cli.(*Client)
+	if ok && clientSecret == "" && usesTLSClientAuth(client.TokenEndpointAuthMethod) {
+		if err = verifyClientCertificate(r, client); err != nil {
+			log.Println("Invalid client certificate:", err)
+			client, err = nil, errors.ErrInvalidClient
+		}
+		return
+	}
+	if method == "none" && !publicClientEndpoints.Contains(r.URL.Path) {
+		client = nil
+		err = errors.ErrInvalidClient
+		return
+	}
+	if !ok || !client.AllowsAuthMethod(method) || !client.VerifySecret(clientSecret) {
+		client = nil
+		err = errors.ErrInvalidClient
+	}
+	return
+}
+
+// authenticateClientAssertion verifies the JWT the client signed with its key (private_key_jwt) or secret (client_secret_jwt)
+// https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+func authenticateClientAssertion(r *http.Request, manager oauth2.Manager) (*Client, error) {
+	if r.FormValue("client_assertion_type") != clientAssertionType {
+		return nil, fmt.Errorf("unsupported client_assertion_type")
+	}
+	assertion := r.FormValue("client_assertion")
+	claims := jwt.MapClaims{}
+	token, _, err := new(jwt.Parser).ParseUnverified(assertion, claims)
+	if err != nil {
+		return nil, err
+	}
+	clientID, _ := claims["sub"].(string)
+	if iss, _ := claims["iss"].(string); clientID == "" || iss != clientID {
+		return nil, fmt.Errorf("iss and sub have to be the client_id")
+	}
+	if id := r.FormValue("client_id"); id != "" && id != clientID {
+		return nil, fmt.Errorf("client_id does not match the assertion")
+	}
+
+	cli, err := manager.GetClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	client, ok := cli.(*Client)
+	if !ok {
+		return nil, fmt.Errorf("unknown client %s", clientID)
+	}
+	method := "private_key_jwt"
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		method = "client_secret_jwt"
+	}
+	if !client.AllowsAuthMethod(method) {
+		return nil, fmt.Errorf("client %s does not use %s", clientID, method)
+	}
+
+	parser := &jwt.Parser{ValidMethods: clientAssertionSigningAlgs}
+	if _, err := parser.ParseWithClaims(assertion, jwt.MapClaims{}, clientAssertionKeyFunc(client)); err != nil {
+		return nil, err
+	}
+
+	issuer := getIssuer()
+	if issuer == "" {
+		return nil, fmt.Errorf("ISSUER_URL is not configured")
+	}
+	if !assertionAudienceMatches(claims["aud"], issuer, issuer+"/token", issuer+r.URL.Path) {
+		return nil, fmt.Errorf("assertion is not for this server")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("assertion has no exp")
+	}
+	expiresAt := time.Unix(int64(exp), 0)
+	if time.Until(expiresAt) > maxAssertionLifetime() {
+		return nil, fmt.Errorf("assertion expires too late")
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, fmt.Errorf("assertion has no jti")
+	}
+	if clientAssertions == nil {
+		return nil, fmt.Errorf("client assertions are not set up")
+	}
+	// client IDs are kept apart from the trusted issuers of the jwt-bearer grant
+	fresh, err := clientAssertions.Use("client:"+clientID, jti, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		securityEvent(r.Context(), "client_assertion_replay", map[string]string{"client_id": clientID, "jti": jti})
+		return nil, fmt.Errorf("assertion %s was already used", jti)
+	}
+	return client, nil
+}
+
+// clientAssertionKeyFunc returns the client secret for HMAC and the registered public keys otherwise,
+// so the algorithm of the assertion can not switch between them
+func clientAssertionKeyFunc(client *Client) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			secret, err := openClientSecret(client.SecretSealed)
+			if err != nil {
+				return nil, err
+			}
+			return []byte(secret), nil
+		}
+
+		var set *jwk.Set
+		var err error
+		switch {
+		case client.JWKSURI != "":
+			set, err = fetchJWKS(client.JWKSURI)
+		case len(client.JWKS) > 0:
+			var data []byte
+			if data, err = json.Marshal(client.JWKS); err == nil {
+				set, err = jwk.Parse(data)
+			}
+		default:
+			err = fmt.Errorf("client %s has no keys", client.ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return assertionKeyFunc(set)(t)
+	}
+}
+
+// clientSecretKey returns the AES key of CLIENT_SECRET_KEY, without it secrets are only hashed
+func clientSecretKey() ([]byte, error) {
+	value := os.Getenv("CLIENT_SECRET_KEY")
+	if value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("CLIENT_SECRET_KEY has to be base64 encoded: %s", err)
+	}
+	return key, nil
+}
+
+func clientSecretAEAD() (cipher.AEAD, error) {
+	key, err := clientSecretKey()
+	if err != nil || key == nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealClientSecret encrypts the secret with AES-GCM, it returns empty string when no key is configured
+func sealClientSecret(secret string) (string, error) {
+	aead, err := clientSecretAEAD()
+	if err != nil || aead == nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func openClientSecret(sealed string) (string, error) {
+	aead, err := clientSecretAEAD()
+	if err != nil {
+		return "", err
+	}
+	if aead == nil || sealed == "" {
+		return "", fmt.Errorf("client secret is not available for client_secret_jwt")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("sealed client secret is too short")
+	}
+	secret, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// clientInfoHandler authenticates the client for the token endpoint, the manager then compares
+// the returned secret with the client's GetSecret, so the stored hash is passed on
+func clientInfoHandler(manager oauth2.Manager) server.ClientInfoHandler {
+	return func(r *http.Request) (clientID, clientSecret string, err error) {
+		client, err := authenticateClient(r, manager)
+		if err != nil {
+			return
+		}
+		clientID, clientSecret = client.GetID(), client.GetSecret()
+		return
+	}
+}
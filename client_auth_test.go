@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graphql-services/oauth/database"
+	"github.com/lestrrat/go-jwx/jwk"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/manage"
+)
+
+func TestAuthenticateClientAssertion(t *testing.T) {
+	os.Setenv("ISSUER_URL", "https://auth.example.com")
+	os.Setenv("CLIENT_SECRET_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	defer os.Unsetenv("ISSUER_URL")
+	defer os.Unsetenv("CLIENT_SECRET_KEY")
+
+	db := database.NewDBWithString("sqlite3://:memory:")
+	clients := ClientStore{DB: db}
+	clientAssertions = &AssertionStore{DB: db}
+	defer func() { clientAssertions = nil }()
+	for _, migrate := range []func() error{clients.AutoMigrate, clientAssertions.AutoMigrate} {
+		if err := migrate(); err != nil {
+			t.Fatalf("[%v] Failed to automigrate", err)
+		}
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pk, _ := jwk.New(&key.PublicKey)
+	data, _ := json.Marshal(pk)
+	var jwks database.JSONMap
+	json.Unmarshal([]byte(`{"keys":[`+string(data)+`]}`), &jwks)
+	if err := clients.Create(&Client{ID: "svc", TokenEndpointAuthMethod: "private_key_jwt", JWKS: jwks}); err != nil {
+		t.Fatalf("[%v] Failed to create client", err)
+	}
+	secretClient := &Client{ID: "app", TokenEndpointAuthMethod: "client_secret_jwt"}
+	if err := secretClient.SetSecret("secret"); err != nil {
+		t.Fatalf("[%v] Failed to set secret", err)
+	}
+	if err := clients.Create(secretClient); err != nil {
+		t.Fatalf("[%v] Failed to create client", err)
+	}
+	m := manage.NewDefaultManager()
+	m.MapClientStorage(&clients)
+
+	assertion := func(method jwt.SigningMethod, signingKey interface{}, clientID string, claims jwt.MapClaims) string {
+		values := jwt.MapClaims{"iss": clientID, "sub": clientID, "aud": "https://auth.example.com/token", "jti": "a1", "exp": time.Now().Add(time.Minute).Unix()}
+		for k, v := range claims {
+			if v == nil {
+				delete(values, k)
+				continue
+			}
+			values[k] = v
+		}
+		s, err := jwt.NewWithClaims(method, values).SignedString(signingKey)
+		if err != nil {
+			t.Fatalf("[%v] Failed to sign assertion", err)
+		}
+		return s
+	}
+
+	cases := []struct {
+		name      string
+		assertion string
+		clientID  string
+		err       error
+	}{
+		{"private_key_jwt", assertion(jwt.SigningMethodES256, key, "svc", nil), "svc", nil},
+		{"replayed jti", assertion(jwt.SigningMethodES256, key, "svc", nil), "", errors.ErrInvalidClient},
+		{"same jti of other client", assertion(jwt.SigningMethodHS256, []byte("secret"), "app", nil), "app", nil},
+		{"other key", assertion(jwt.SigningMethodES256, otherKey, "svc", jwt.MapClaims{"jti": "a2"}), "", errors.ErrInvalidClient},
+		{"secret of private_key_jwt client", assertion(jwt.SigningMethodHS256, []byte("secret"), "svc", jwt.MapClaims{"jti": "a3"}), "", errors.ErrInvalidClient},
+		{"wrong audience", assertion(jwt.SigningMethodES256, key, "svc", jwt.MapClaims{"jti": "a4", "aud": "https://other.example.com/token"}), "", errors.ErrInvalidClient},
+		{"issuer is not the client", assertion(jwt.SigningMethodES256, key, "svc", jwt.MapClaims{"jti": "a5", "iss": "app"}), "", errors.ErrInvalidClient},
+		{"missing jti", assertion(jwt.SigningMethodES256, key, "svc", jwt.MapClaims{"jti": nil}), "", errors.ErrInvalidClient},
+		{"expired", assertion(jwt.SigningMethodES256, key, "svc", jwt.MapClaims{"jti": "a6", "exp": time.Now().Add(-time.Minute).Unix()}), "", errors.ErrInvalidClient},
+		{"expires too late", assertion(jwt.SigningMethodES256, key, "svc", jwt.MapClaims{"jti": "a7", "exp": time.Now().Add(24 * time.Hour).Unix()}), "", errors.ErrInvalidClient},
+	}
+	for _, c := range cases {
+		form := url.Values{"client_assertion_type": {clientAssertionType}, "client_assertion": {c.assertion}}
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		client, err := authenticateClient(r, m)
+		if err != c.err {
+			t.Errorf("[%s] expected %v, got %v", c.name, c.err, err)
+			continue
+		}
+		if err == nil && client.ID != c.clientID {
+			t.Errorf("[%s] expected client %s, got %s", c.name, c.clientID, client.ID)
+		}
+	}
+}
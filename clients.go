@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/graphql-services/oauth/database"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+// Client registered OAuth2 client
+type Client struct {
+	ID         string `gorm:"primary_key" json:"client_id"`
+	SecretHash string `json:"-"`
+	// SecretSealed secret encrypted with CLIENT_SECRET_KEY, client_secret_jwt needs the plain secret to verify the assertion
+	SecretSealed string `json:"-"`
+	// RedirectURIs must match the redirect_uri exactly
+	RedirectURIs database.StringList `gorm:"type:text" json:"redirect_uris"`
+	// GrantTypes allowed for the client, empty list allows all grant types of the server except token exchange and JWT bearer
+	GrantTypes database.StringList `gorm:"type:text" json:"grant_types"`
+	// Scopes allowed for the client, empty list allows any scope
+	Scopes database.StringList `gorm:"type:text" json:"scopes"`
+	// AccessTokenLifetime and RefreshTokenLifetime in seconds override the server defaults when set
+	AccessTokenLifetime  int `json:"access_token_lifetime,omitempty"`
+	RefreshTokenLifetime int `json:"refresh_token_lifetime,omitempty"`
+	// RequirePKCE rejects authorization code requests without code_challenge
+	RequirePKCE bool `json:"require_pkce"`
+	// PKCES256Only rejects the plain code_challenge_method
+	PKCES256Only bool `json:"pkce_s256_only"`
+	// RequirePushedAuthorizationRequests rejects authorization requests which were not pushed to /par
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests"`
+	// PostLogoutRedirectURIs the user can be sent back to after logout, see logout.go
+	PostLogoutRedirectURIs database.StringList `gorm:"type:text" json:"post_logout_redirect_uris"`
+	// RequestURIs the request objects of the client can be fetched from, see request_object.go
+	RequestURIs database.StringList `gorm:"type:text" json:"request_uris"`
+	// ResponseTypes allowed for the client, empty list allows all response types of the server
+	ResponseTypes database.StringList `gorm:"type:text" json:"response_types"`
+	// TokenEndpointAuthMethod registered for the client, empty allows any method the client has credentials for
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method,omitempty"`
+	// JWKS or JWKSURI with public keys of the client
+	JWKS    database.JSONMap `gorm:"type:text" json:"jwks,omitempty"`
+	JWKSURI string           `json:"jwks_uri,omitempty"`
+	// TLSClientAuthSubjectDN of the certificate of tls_client_auth clients, see mtls.go
+	TLSClientAuthSubjectDN string `json:"tls_client_auth_subject_dn,omitempty"`
+	// TLSClientCertificateThumbprint pinned certificate (x5t#S256) of self_signed_tls_client_auth clients
+	TLSClientCertificateThumbprint string `json:"tls_client_certificate_thumbprint,omitempty"`
+	// RegistrationAccessTokenHash of dynamically registered clients, see registration.go
+	RegistrationAccessTokenHash string           `json:"-"`
+	UserID                      string           `json:"user_id,omitempty"`
+	Metadata                    database.JSONMap `gorm:"type:text" json:"metadata"`
+	// Disabled clients can not authenticate nor get any tokens
+	Disabled  bool       `json:"disabled"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// GetID client id
+func (c *Client) GetID() string {
+	return c.ID
+}
+
+// GetSecret returns the secret hash, the plain secret is verified by VerifySecret before the manager compares it
+func (c *Client) GetSecret() string {
+	return c.SecretHash
+}
+
+// GetDomain returns the registered redirect URIs separated by space, see validateRedirectURI
+func (c *Client) GetDomain() string {
+	return strings.Join(c.RedirectURIs, " ")
+}
+
+// GetUserID user id
+func (c *Client) GetUserID() string {
+	return c.UserID
+}
+
+// IsPublic clients have no credentials, they are expected to use PKCE.
+// private_key_jwt and mutual TLS clients authenticate with their keys.
+func (c *Client) IsPublic() bool {
+	return c.SecretHash == "" && c.TokenEndpointAuthMethod != "private_key_jwt" && !usesTLSClientAuth(c.TokenEndpointAuthMethod)
+}
+
+// SetSecret stores hash of the secret, empty secret makes the client public
+func (c *Client) SetSecret(secret string) error {
+	if secret == "" {
+		c.SecretHash = ""
+		c.SecretSealed = ""
+		return nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	c.SecretHash = string(hash)
+	c.SecretSealed, err = sealClientSecret(secret)
+	return err
+}
+
+// VerifySecret compares the secret with the stored hash
+func (c *Client) VerifySecret(secret string) bool {
+	if c.IsPublic() {
+		return secret == ""
+	}
+	return bcrypt.CompareHashAndPassword([]byte(c.SecretHash), []byte(secret)) == nil
+}
+
+// AllowsGrantType ...
+func (c *Client) AllowsGrantType(gt oauth2.GrantType) bool {
+	// tokens of the client itself need authentication with a secret
+	if gt == oauth2.ClientCredentials && c.IsPublic() {
+		return false
+	}
+	if len(c.GrantTypes) == 0 {
+		// tokens for other parties than the client have to be enabled explicitly
+		return gt != oauth2.GrantType(tokenExchangeGrantType) && gt != oauth2.GrantType(jwtBearerGrantType)
+	}
+	if gt == oauth2.Implicit {
+		return c.GrantTypes.Contains("implicit")
+	}
+	return c.GrantTypes.Contains(string(gt))
+}
+
+// AllowsResponseType ...
+func (c *Client) AllowsResponseType(rt oauth2.ResponseType) bool {
+	if len(c.ResponseTypes) == 0 {
+		return true
+	}
+	return c.ResponseTypes.Contains(rt.String())
+}
+
+// AllowsAuthMethod checks the method used to authenticate at the token endpoint
+func (c *Client) AllowsAuthMethod(method string) bool {
+	if c.TokenEndpointAuthMethod == "" {
+		return true
+	}
+	return c.TokenEndpointAuthMethod == method
+}
+
+// AllowsRequestURI checks the request_uri is registered, the fragment is not part of the comparison
+func (c *Client) AllowsRequestURI(uri string) bool {
+	uri = requestURIWithoutFragment(uri)
+	for _, registered := range c.RequestURIs {
+		if requestURIWithoutFragment(registered) == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsScope checks every requested scope is allowed for the client,
+// empty scopes allow all except the admin scope, which has to be listed explicitly
+func (c *Client) AllowsScope(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if len(c.Scopes) == 0 && s != getAdminScope() {
+			continue
+		}
+		if !c.Scopes.Contains(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyTokenLifetimes overrides expiration of the token being generated with the client lifetimes
+func (c *Client) applyTokenLifetimes(ti oauth2.TokenInfo) {
+	if c.AccessTokenLifetime > 0 {
+		ti.SetAccessExpiresIn(time.Second * time.Duration(c.AccessTokenLifetime))
+	}
+	if c.RefreshTokenLifetime > 0 && ti.GetRefreshExpiresIn() > 0 {
+		ti.SetRefreshExpiresIn(time.Second * time.Duration(c.RefreshTokenLifetime))
+	}
+}
+
+// generateSecret generates random client secrets and tokens
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ClientStore GORM backed client store
+type ClientStore struct {
+	DB *database.DB
+}
+
+func (s *ClientStore) AutoMigrate() error {
+	return s.DB.AutoMigrate(&Client{})
+}
+
+// GetByID according to the ID for the client information
+func (s *ClientStore) GetByID(id string) (oauth2.ClientInfo, error) {
+	c, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || c.Disabled {
+		return nil, errors.ErrInvalidClient
+	}
+	return c, nil
+}
+
+func (s *ClientStore) Get(id string) (c *Client, err error) {
+	var client Client
+	res := s.DB.Client().First(&client, &Client{ID: id})
+	if res.RecordNotFound() {
+		return
+	}
+	err = res.Error
+	if err != nil {
+		return
+	}
+	c = &client
+	return
+}
+
+func (s *ClientStore) Create(c *Client) error {
+	return s.DB.Client().Create(c).Error
+}
+
+func (s *ClientStore) Update(c *Client) error {
+	return s.DB.Client().Save(c).Error
+}
+
+func (s *ClientStore) Delete(id string) error {
+	return s.DB.Client().Delete(&Client{ID: id}).Error
+}
+
+func (s *ClientStore) List() (clients []*Client, err error) {
+	clients = []*Client{}
+	err = s.DB.Client().Order("created_at").Find(&clients).Error
+	return
+}
+
+// ClientSeed client definition of the seed file, the secret is hashed when stored
+type ClientSeed struct {
+	Client
+	Secret string `json:"client_secret"`
+}
+
+// Seed creates clients from the seed file which do not exist yet, existing clients are left untouched
+func (s *ClientStore) Seed() error {
+	filename := os.Getenv("CLIENTS_SEED_FILE")
+	if filename == "" {
+		filename = "clients.json"
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var seeds []ClientSeed
+	if err := json.Unmarshal(data, &seeds); err != nil {
+		return err
+	}
+
+	for _, seed := range seeds {
+		existing, err := s.Get(seed.ID)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+
+		c := seed.Client
+		if err := c.SetSecret(seed.Secret); err != nil {
+			return err
+		}
+		if err := s.Create(&c); err != nil {
+			return err
+		}
+		log.Printf("Seeded client %s", c.ID)
+	}
+	return nil
+}
+
+// ClientAuthorizedHandler checks the client is allowed to use the grant type
+func (s *ClientStore) ClientAuthorizedHandler(clientID string, gt oauth2.GrantType) (allowed bool, err error) {
+	c, err := s.Get(clientID)
+	if err != nil || c == nil {
+		return
+	}
+	allowed = c.AllowsGrantType(gt)
+	return
+}
+
+// ClientScopeHandler checks the client is allowed to request the scope
+func (s *ClientStore) ClientScopeHandler(clientID, scope string) (allowed bool, err error) {
+	c, err := s.Get(clientID)
+	if err != nil || c == nil {
+		return
+	}
+	allowed = c.AllowsScope(scope)
+	return
+}
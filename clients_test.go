@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+func TestClientStoreSeed(t *testing.T) {
+	f, err := ioutil.TempFile("", "clients*.json")
+	if err != nil {
+		t.Fatalf("[%v] Failed to create seed file", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[
+		{"client_id": "default", "client_secret": "default", "redirect_uris": ["https://example.com/callback"], "scopes": ["openid"]},
+		{"client_id": "spa", "redirect_uris": ["https://spa.example.com/callback"]}
+	]`)
+	f.Close()
+	os.Setenv("CLIENTS_SEED_FILE", f.Name())
+	defer os.Unsetenv("CLIENTS_SEED_FILE")
+
+	s := ClientStore{DB: database.NewDBWithString("sqlite3://:memory:")}
+	if err := s.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	if err := s.Seed(); err != nil {
+		t.Fatalf("[%v] Failed to seed clients", err)
+	}
+
+	c, err := s.Get("default")
+	if err != nil || c == nil {
+		t.Fatalf("[%v] seeded client should exist", err)
+	}
+	if c.SecretHash == "default" || !c.VerifySecret("default") || c.VerifySecret("") {
+		t.Errorf("secret should be stored hashed and verified")
+	}
+	if c.GetDomain() != "https://example.com/callback" || !c.AllowsScope("openid") || c.AllowsScope("openid custom") {
+		t.Errorf("seeded client should keep its redirect URIs and scopes, got %+v", c)
+	}
+	if spa, _ := s.Get("spa"); spa == nil || !spa.IsPublic() {
+		t.Errorf("client without secret should be public")
+	}
+
+	// existing clients are left untouched
+	c.RedirectURIs = database.StringList{"https://changed.example.com/callback"}
+	if err := s.Update(c); err != nil {
+		t.Fatalf("[%v] Failed to update client", err)
+	}
+	if err := s.Seed(); err != nil {
+		t.Fatalf("[%v] Failed to seed clients again", err)
+	}
+	if c, _ := s.Get("default"); c.GetDomain() != "https://changed.example.com/callback" {
+		t.Errorf("seed should not overwrite existing client, got %s", c.GetDomain())
+	}
+}
+
+func TestClientStoreGetByID(t *testing.T) {
+	s := ClientStore{DB: database.NewDBWithString("sqlite3://:memory:")}
+	if err := s.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	for _, c := range []*Client{{ID: "active"}, {ID: "disabled", Disabled: true}} {
+		if err := s.Create(c); err != nil {
+			t.Fatalf("[%v] Failed to create client", err)
+		}
+	}
+
+	if cli, err := s.GetByID("active"); err != nil || cli.GetID() != "active" {
+		t.Errorf("[%v] active client should be found", err)
+	}
+	for _, id := range []string{"disabled", "unknown"} {
+		if _, err := s.GetByID(id); err != errors.ErrInvalidClient {
+			t.Errorf("[%s] expected invalid client, got %v", id, err)
+		}
+	}
+}
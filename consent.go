@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-session/session"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// Consent scopes the user granted to the client
+type Consent struct {
+	UserID    string              `gorm:"primary_key" json:"-"`
+	ClientID  string              `gorm:"primary_key" json:"client_id"`
+	Scopes    database.StringList `gorm:"type:text" json:"scopes"`
+	UpdatedAt *time.Time          `json:"updated_at"`
+	CreatedAt time.Time           `json:"created_at"`
+}
+
+// Covers checks every requested scope was granted
+func (c *Consent) Covers(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if !c.Scopes.Contains(s) {
+			return false
+		}
+	}
+	return true
+}
+
+type ConsentStore struct {
+	DB *database.DB
+}
+
+func (s *ConsentStore) AutoMigrate() error {
+	return s.DB.AutoMigrate(&Consent{})
+}
+
+func (s *ConsentStore) Get(userID, clientID string) (c *Consent, err error) {
+	var consent Consent
+	res := s.DB.Client().First(&consent, &Consent{UserID: userID, ClientID: clientID})
+	if res.RecordNotFound() {
+		return
+	}
+	err = res.Error
+	if err != nil {
+		return
+	}
+	c = &consent
+	return
+}
+
+// Grant adds the scopes to the scopes already granted to the client
+func (s *ConsentStore) Grant(userID, clientID string, scopes []string) error {
+	c, err := s.Get(userID, clientID)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		c = &Consent{UserID: userID, ClientID: clientID, Scopes: database.StringList{}}
+	}
+	for _, scope := range scopes {
+		if !c.Scopes.Contains(scope) {
+			c.Scopes = append(c.Scopes, scope)
+		}
+	}
+	return s.DB.Client().Save(c).Error
+}
+
+func (s *ConsentStore) List(userID string) (consents []*Consent, err error) {
+	consents = []*Consent{}
+	err = s.DB.Client().Where(&Consent{UserID: userID}).Order("created_at").Find(&consents).Error
+	return
+}
+
+func (s *ConsentStore) Delete(userID, clientID string) error {
+	return s.DB.Client().Delete(&Consent{UserID: userID, ClientID: clientID}).Error
+}
+
+func (s *ConsentStore) DeleteAll(userID string) error {
+	return s.DB.Client().Where("user_id = ?", userID).Delete(&Consent{}).Error
+}
+
+// scopeDescriptions are shown on the consent page, unknown scopes are shown by name
+var scopeDescriptions = map[string]string{
+	"openid":         "Sign you in with your account",
+	"profile":        "See your name and basic profile information",
+	"email":          "See your email address",
+	"phone":          "See your phone number",
+	"address":        "See your postal address",
+	"offline_access": "Keep access while you are not using the application",
+	consentsScope:    "See and revoke the applications you gave access",
+}
+
+func scopeDescription(scope string) string {
+	if d, ok := scopeDescriptions[scope]; ok {
+		return d
+	}
+	return "Access " + scope
+}
+
+// consentKey identifies the authorization request the user approved or denied on the consent page
+func consentKey(clientID, scope string) string {
+	return clientID + " " + scope
+}
+
+func hasPrompt(r *http.Request, prompt string) bool {
+	for _, p := range strings.Fields(r.FormValue("prompt")) {
+		if p == prompt {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConsent returns the user once the requested scopes are consented,
+// otherwise the authorization request is saved and the user is sent to the consent page
+func checkConsent(w http.ResponseWriter, r *http.Request, store session.Store, consents *ConsentStore, userID string) (string, error) {
+	clientID, scope := r.FormValue("client_id"), r.FormValue("scope")
+	key := consentKey(clientID, scope)
+
+	// decisions of the consent page are used once, so prompt=consent does not loop
+	if v, ok := store.Get("ConsentDenied"); ok && v == key {
+		store.Delete("ConsentDenied")
+		store.Save()
+		return "", errors.ErrAccessDenied
+	}
+	if v, ok := store.Get("ConsentApproved"); ok && v == key {
+		store.Delete("ConsentApproved")
+		store.Save()
+		return userID, nil
+	}
+
+	if !hasPrompt(r, "consent") {
+		c, err := consents.Get(userID, clientID)
+		if err != nil {
+			return "", err
+		}
+		if c != nil && c.Covers(scope) {
+			return userID, nil
+		}
+	}
+
+	if hasPrompt(r, "none") {
+		return "", ErrConsentRequired
+	}
+	store.Set("ReturnUri", r.Form)
+	if err := store.Save(); err != nil {
+		return "", err
+	}
+	w.Header().Set("Location", "/consent")
+	w.WriteHeader(http.StatusFound)
+	return "", nil
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(pageHead + `
+	<h1>{{.ClientName}}</h1>
+	<p>would like to:</p>
+	<ul>
+		{{range .Scopes}}<li>{{.}}</li>{{end}}
+	</ul>
+	<form method="post" action="/consent">
+		<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+		<button type="submit" name="action" value="approve">Allow</button>
+		<button type="submit" name="action" value="deny">Deny</button>
+	</form>
+</body>
+</html>
+`))
+
+type consentPage struct {
+	Title      string
+	CSRFToken  string
+	ClientName string
+	Scopes     []string
+}
+
+// consentHandler shows the scopes of the saved authorization request and records the decision of the user
+func consentHandler(clients *ClientStore, consents *ConsentStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store, err := session.Start(nil, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		uid, ok := store.Get("LoggedInUserID")
+		if !ok {
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		v, _ := store.Get("ReturnUri")
+		form, ok := v.(url.Values)
+		if !ok {
+			http.Error(w, "No authorization request to consent", http.StatusBadRequest)
+			return
+		}
+		clientID, scope := form.Get("client_id"), form.Get("scope")
+
+		switch r.Method {
+		case http.MethodGet:
+			client, err := clients.Get(clientID)
+			if err != nil || client == nil {
+				http.Error(w, "Unknown client", http.StatusBadRequest)
+				return
+			}
+			page := consentPage{Title: "Authorize", ClientName: client.ID}
+			if name, ok := client.Metadata["client_name"].(string); ok && name != "" {
+				page.ClientName = name
+			}
+			for _, s := range strings.Fields(scope) {
+				page.Scopes = append(page.Scopes, scopeDescription(s))
+			}
+			if page.CSRFToken, err = csrfToken(store); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			renderPage(w, consentTemplate, http.StatusOK, page)
+		case http.MethodPost:
+			if !validCSRFToken(store, r) {
+				http.Error(w, "The form has expired, please try again", http.StatusForbidden)
+				return
+			}
+			if r.PostFormValue("action") == "approve" {
+				if err := consents.Grant(uid.(string), clientID, strings.Fields(scope)); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				store.Set("ConsentApproved", consentKey(clientID, scope))
+			} else {
+				store.Set("ConsentDenied", consentKey(clientID, scope))
+			}
+			store.Delete("ReturnUri")
+			if err := store.Save(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Location", "/authorize?"+authorizeReturnQuery(form))
+			w.WriteHeader(http.StatusFound)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// ConsentResponse consent with the client name for the consent management API
+type ConsentResponse struct {
+	*Consent
+	ClientName string `json:"client_name,omitempty"`
+}
+
+// consentsScope has to be granted to the access token of the consent management API,
+// so third-party clients can not revoke access of the other clients without the user's consent
+const consentsScope = "consents"
+
+// consentsHandler lets users manage access of the clients with their own access token
+//
+//	GET /consents lists the clients and granted scopes
+//	DELETE /consents/{client_id} revokes access of the client
+//	DELETE /consents revokes access of all clients
+//
+// Revoking deletes the consent together with the user's tokens of the client.
+func consentsHandler(srv *server.Server, clients *ClientStore, consents *ConsentStore, db *database.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ti, ok := validateBearerToken(w, r, srv)
+		if !ok {
+			return
+		}
+		userID := ti.GetUserID()
+		if userID == "" {
+			writeBearerError(w, http.StatusForbidden, "insufficient_scope", "The access token was not issued to a user")
+			return
+		}
+		if !containsScope(ti.GetScope(), consentsScope) {
+			writeBearerError(w, http.StatusForbidden, "insufficient_scope", "The access token was not granted the consents scope", consentsScope)
+			return
+		}
+		clientID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/consents"), "/")
+
+		switch {
+		case r.Method == http.MethodGet && clientID == "":
+			list, err := consents.List(userID)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			res := []ConsentResponse{}
+			for _, c := range list {
+				item := ConsentResponse{Consent: c}
+				if client, err := clients.Get(c.ClientID); err == nil && client != nil {
+					item.ClientName, _ = client.Metadata["client_name"].(string)
+				}
+				res = append(res, item)
+			}
+			writeJSON(w, http.StatusOK, res)
+		case r.Method == http.MethodDelete && clientID == "":
+			if err := consents.DeleteAll(userID); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := removeUserTokens(db, userID, ""); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete:
+			c, err := consents.Get(userID, clientID)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if c == nil {
+				writeJSONError(w, http.StatusNotFound, fmt.Errorf("no consent for client %s", clientID))
+				return
+			}
+			if err := consents.Delete(userID, clientID); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := removeUserTokens(db, userID, clientID); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-session/session"
+	"github.com/graphql-services/oauth/database"
+	oauth2gorm "github.com/techknowlogick/go-oauth2-gorm"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/models"
+	"gopkg.in/oauth2.v3/server"
+)
+
+func TestCheckConsent(t *testing.T) {
+	consents := ConsentStore{DB: database.NewDBWithString("sqlite3://:memory:")}
+	if err := consents.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	if err := consents.Grant("u1", "app", []string{"openid", "email"}); err != nil {
+		t.Fatalf("[%v] Failed to grant consent", err)
+	}
+
+	cases := []struct {
+		name     string
+		query    string
+		userID   string
+		location string
+		err      error
+	}{
+		{"granted scopes", "client_id=app&scope=openid", "u1", "", nil},
+		{"new scope", "client_id=app&scope=openid+profile", "", "/consent", nil},
+		{"prompt consent", "client_id=app&scope=openid&prompt=consent", "", "/consent", nil},
+		{"prompt none", "client_id=app&scope=openid+profile&prompt=none", "", "", ErrConsentRequired},
+		{"other client", "client_id=other&scope=openid", "", "/consent", nil},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/authorize?"+c.query, nil)
+		r.ParseForm()
+		store, err := session.Start(nil, w, r)
+		if err != nil {
+			t.Fatalf("[%v] Failed to start session", err)
+		}
+		userID, err := checkConsent(w, r, store, &consents, "u1")
+		if userID != c.userID || err != c.err || w.Header().Get("Location") != c.location {
+			t.Errorf("[%s] expected %q %v %q, got %q %v %q", c.name, c.userID, c.err, c.location, userID, err, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestConsentHandler(t *testing.T) {
+	db := database.NewDBWithString("sqlite3://:memory:")
+	clients := ClientStore{DB: db}
+	consents := ConsentStore{DB: db}
+	for _, migrate := range []func() error{clients.AutoMigrate, consents.AutoMigrate} {
+		if err := migrate(); err != nil {
+			t.Fatalf("[%v] Failed to automigrate", err)
+		}
+	}
+	if err := clients.Create(&Client{ID: "app", Metadata: database.JSONMap{"client_name": "Example App"}}); err != nil {
+		t.Fatalf("[%v] Failed to create client", err)
+	}
+	handler := consentHandler(&clients, &consents)
+
+	cases := []struct {
+		name    string
+		action  string
+		csrf    bool
+		granted bool
+		decided string
+	}{
+		{"missing csrf token", "approve", false, false, ""},
+		{"deny", "deny", true, false, "ConsentDenied"},
+		{"approve", "approve", true, true, "ConsentApproved"},
+	}
+	for _, c := range cases {
+		// the authorization request saved by checkConsent
+		w := httptest.NewRecorder()
+		store, err := session.Start(nil, w, httptest.NewRequest("GET", "/authorize", nil))
+		if err != nil {
+			t.Fatalf("[%v] Failed to start session", err)
+		}
+		store.Set("LoggedInUserID", "u-"+c.name)
+		store.Set("ReturnUri", url.Values{"client_id": {"app"}, "scope": {"openid email"}})
+		if err := store.Save(); err != nil {
+			t.Fatalf("[%v] Failed to save session", err)
+		}
+		cookie := testSessionCookie(t, w)
+
+		r := httptest.NewRequest("GET", "/consent", nil)
+		r.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		handler(w, r)
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(body, "Example App") || !strings.Contains(body, scopeDescription("email")) {
+			t.Fatalf("[%s] consent page should show the client and scopes, got %d", c.name, w.Code)
+		}
+
+		form := url.Values{"action": {c.action}}
+		if c.csrf {
+			form.Set("csrf_token", csrfTokenPattern.FindStringSubmatch(body)[1])
+		}
+		r = httptest.NewRequest("POST", "/consent", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		handler(w, r)
+
+		if !c.csrf {
+			if w.Code != http.StatusForbidden {
+				t.Errorf("[%s] expected %d, got %d", c.name, http.StatusForbidden, w.Code)
+			}
+		} else if location := w.Header().Get("Location"); w.Code != http.StatusFound || !strings.HasPrefix(location, "/authorize?") {
+			t.Errorf("[%s] should return to the authorization request, got %d %s", c.name, w.Code, location)
+		}
+
+		consent, err := consents.Get("u-"+c.name, "app")
+		if err != nil {
+			t.Fatalf("[%v] Failed to get consent", err)
+		}
+		if (consent != nil && consent.Covers("openid email")) != c.granted {
+			t.Errorf("[%s] consent granted: %v", c.name, consent != nil)
+		}
+		if c.decided != "" {
+			r := httptest.NewRequest("GET", "/authorize", nil)
+			r.AddCookie(cookie)
+			store, _ := session.Start(nil, httptest.NewRecorder(), r)
+			if v, _ := store.Get(c.decided); v != consentKey("app", "openid email") {
+				t.Errorf("[%s] decision should be recorded for the authorization request, got %v", c.name, v)
+			}
+		}
+	}
+}
+
+func TestConsentsHandler(t *testing.T) {
+	defer useTestSigningKey(t)()
+
+	db := database.NewDBWithString("sqlite3://:memory:")
+	clients := ClientStore{DB: db}
+	consents := ConsentStore{DB: db}
+	for _, migrate := range []func() error{clients.AutoMigrate, consents.AutoMigrate} {
+		if err := migrate(); err != nil {
+			t.Fatalf("[%v] Failed to automigrate", err)
+		}
+	}
+	for _, clientID := range []string{"app", "other"} {
+		if err := consents.Grant("u1", clientID, []string{"openid"}); err != nil {
+			t.Fatalf("[%v] Failed to grant consent", err)
+		}
+	}
+	tokens := oauth2gorm.NewStoreWithDB(&oauth2gorm.Config{TableName: tokenTableName}, db.Client(), 1800)
+	m := manage.NewDefaultManager()
+	m.MapTokenStorage(tokens)
+	handler := consentsHandler(server.NewDefaultServer(m), &clients, &consents, db)
+
+	appToken := createTestAccessToken(t, tokens, &models.Token{ClientID: "app", UserID: "u1", Scope: "openid"}, nil)
+	otherToken := createTestAccessToken(t, tokens, &models.Token{ClientID: "other", UserID: "u1", Scope: "openid"}, nil)
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		userID     string
+		scope      string
+		statusCode int
+	}{
+		{"without consents scope", "GET", "/consents", "u1", "openid", http.StatusForbidden},
+		{"client credentials", "GET", "/consents", "", "consents", http.StatusForbidden},
+		{"list", "GET", "/consents", "u1", "openid consents", http.StatusOK},
+		{"revoke without consents scope", "DELETE", "/consents/app", "u1", "openid", http.StatusForbidden},
+		{"revoke", "DELETE", "/consents/app", "u1", "consents", http.StatusNoContent},
+		{"revoke again", "DELETE", "/consents/app", "u1", "consents", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		access := createTestAccessToken(t, tokens, &models.Token{ClientID: "manager", UserID: c.userID, Scope: c.scope}, nil)
+		r := httptest.NewRequest(c.method, c.path, nil)
+		r.Header.Set("Authorization", "Bearer "+access)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.statusCode {
+			t.Errorf("[%s] expected %d, got %d", c.name, c.statusCode, w.Code)
+		}
+		if c.method == "GET" && w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"client_id":"other"`) {
+			t.Errorf("[%s] consents should be listed, got %s", c.name, w.Body.String())
+		}
+	}
+
+	if c, _ := consents.Get("u1", "app"); c != nil {
+		t.Errorf("consent of the client should be deleted")
+	}
+	if ti, _ := tokens.GetByAccess(appToken); ti != nil {
+		t.Errorf("tokens of the client should be deleted")
+	}
+	if ti, _ := tokens.GetByAccess(otherToken); ti == nil {
+		t.Errorf("tokens of the other client should be kept")
+	}
+}
@@ -71,3 +71,17 @@ func (db *DB) AutoMigrate(values ...interface{}) error {
 func (db *DB) Close() error {
 	return db.db.Close()
 }
+
+// IsUniqueViolation reports whether the insert failed on a primary key or unique index of one of the dialects
+func IsUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, s := range []string{"UNIQUE constraint failed", "Duplicate entry", "duplicate key value", "Cannot insert duplicate key"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
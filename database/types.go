@@ -0,0 +1,69 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// StringList list of strings stored as JSON array
+type StringList []string
+
+// Value ...
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		l = StringList{}
+	}
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+// Scan ...
+func (l *StringList) Scan(src interface{}) error {
+	return scanJSON(src, l)
+}
+
+// Contains ...
+func (l StringList) Contains(s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// JSONMap object stored as JSON
+type JSONMap map[string]interface{}
+
+// Value ...
+func (m JSONMap) Value() (driver.Value, error) {
+	if m == nil {
+		m = JSONMap{}
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+// Scan ...
+func (m *JSONMap) Scan(src interface{}) error {
+	return scanJSON(src, m)
+}
+
+func scanJSON(src interface{}, v interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		if len(s) == 0 {
+			return nil
+		}
+		return json.Unmarshal(s, v)
+	case string:
+		if s == "" {
+			return nil
+		}
+		return json.Unmarshal([]byte(s), v)
+	}
+	return fmt.Errorf("cannot scan %T into %T", src, v)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/rand"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-session/session"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// deviceCodeGrantType https://tools.ietf.org/html/rfc8628#section-3.4
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+)
+
+// userCodeAlphabet has no vowels, so the codes do not spell words, and no easily confused characters
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// DeviceCode pending device authorization, only hash of the device code is stored
+type DeviceCode struct {
+	DeviceCodeHash string `gorm:"primary_key"`
+	UserCode       string `gorm:"unique_index"`
+	ClientID       string
+	Scope          string
+	UserID         string
+	Status         string
+	// Interval in seconds the client has to wait between polls, it grows with every slow_down
+	Interval     int
+	LastPolledAt *time.Time
+	ExpiresAt    time.Time
+	CreatedAt    time.Time
+}
+
+type DeviceCodeStore struct {
+	DB *database.DB
+}
+
+func (s *DeviceCodeStore) AutoMigrate() error {
+	return s.DB.AutoMigrate(&DeviceCode{})
+}
+
+func (s *DeviceCodeStore) Create(c *DeviceCode) error {
+	// codes which were never exchanged are dropped here instead of a separate gc
+	if err := s.DB.Client().Where("expires_at < ?", time.Now()).Delete(&DeviceCode{}).Error; err != nil {
+		return err
+	}
+	return s.DB.Client().Create(c).Error
+}
+
+func (s *DeviceCodeStore) GetByDeviceCode(deviceCode string) (*DeviceCode, error) {
+	return s.get(&DeviceCode{DeviceCodeHash: hashToken(deviceCode)})
+}
+
+func (s *DeviceCodeStore) GetByUserCode(userCode string) (*DeviceCode, error) {
+	return s.get(&DeviceCode{UserCode: normalizeUserCode(userCode)})
+}
+
+func (s *DeviceCodeStore) get(where *DeviceCode) (c *DeviceCode, err error) {
+	var code DeviceCode
+	res := s.DB.Client().First(&code, where)
+	if res.RecordNotFound() {
+		return
+	}
+	err = res.Error
+	if err != nil {
+		return
+	}
+	c = &code
+	return
+}
+
+func (s *DeviceCodeStore) Update(c *DeviceCode) error {
+	return s.DB.Client().Save(c).Error
+}
+
+// Poll records the poll of the device, only the polling columns are written, so the decision of the user is kept
+func (s *DeviceCodeStore) Poll(c *DeviceCode) error {
+	return s.DB.Client().Model(c).Updates(map[string]interface{}{"interval": c.Interval, "last_polled_at": c.LastPolledAt}).Error
+}
+
+// Redeem deletes the approved code, the delete is conditional, so only one of concurrent polls gets the tokens
+func (s *DeviceCodeStore) Redeem(c *DeviceCode) (bool, error) {
+	res := s.DB.Client().Where("device_code_hash = ? AND status = ?", c.DeviceCodeHash, DeviceCodeApproved).Delete(&DeviceCode{})
+	return res.RowsAffected == 1, res.Error
+}
+
+func (s *DeviceCodeStore) Delete(c *DeviceCode) error {
+	return s.DB.Client().Delete(c).Error
+}
+
+func generateUserCode() (string, error) {
+	b := make([]byte, 8)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// normalizeUserCode accepts the code typed in lower case and with or without the dash
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return -1
+	}, strings.ToUpper(code))
+}
+
+// formatUserCode displays the code as XXXX-XXXX
+func formatUserCode(code string) string {
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+func deviceCodeLifetime() time.Duration {
+	return time.Second * time.Duration(getEnvInt("DEVICE_CODE_LIFETIME", 600))
+}
+
+// DeviceAuthorizationResponse https://tools.ietf.org/html/rfc8628#section-3.2
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// deviceAuthorizationHandler https://tools.ietf.org/html/rfc8628#section-3.1
+func deviceAuthorizationHandler(srv *server.Server, devices *DeviceCodeStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		cli, err := authenticateClient(r, srv.Manager)
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+		if !cli.AllowsGrantType(oauth2.GrantType(deviceCodeGrantType)) {
+			writeErrorResponse(w, srv, errors.ErrUnauthorizedClient)
+			return
+		}
+		scope := r.PostFormValue("scope")
+		if !cli.AllowsScope(scope) {
+			writeErrorResponse(w, srv, errors.ErrInvalidScope)
+			return
+		}
+
+		deviceCode, err := generateSecret()
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+		userCode, err := generateUserCode()
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+		c := &DeviceCode{
+			DeviceCodeHash: hashToken(deviceCode),
+			UserCode:       userCode,
+			ClientID:       cli.GetID(),
+			Scope:          scope,
+			Status:         DeviceCodePending,
+			Interval:       5,
+			ExpiresAt:      time.Now().Add(deviceCodeLifetime()),
+		}
+		if err := devices.Create(c); err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+
+		verificationURI := getIssuer() + "/device"
+		writeJSON(w, http.StatusOK, &DeviceAuthorizationResponse{
+			DeviceCode:              deviceCode,
+			UserCode:                formatUserCode(userCode),
+			VerificationURI:         verificationURI,
+			VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(formatUserCode(userCode)),
+			ExpiresIn:               int64(deviceCodeLifetime().Seconds()),
+			Interval:                c.Interval,
+		})
+	}
+}
+
+// verifyDeviceCode returns the approved device code of the token request, pending codes end with the polling errors
+// https://tools.ietf.org/html/rfc8628#section-3.5
+func verifyDeviceCode(r *http.Request, devices *DeviceCodeStore, cli *Client) (*DeviceCode, error) {
+	deviceCode := r.PostFormValue("device_code")
+	if deviceCode == "" {
+		return nil, errors.ErrInvalidRequest
+	}
+	c, err := devices.GetByDeviceCode(deviceCode)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || c.ClientID != cli.GetID() {
+		return nil, errors.ErrInvalidGrant
+	}
+
+	now := time.Now()
+	if now.After(c.ExpiresAt) {
+		devices.Delete(c)
+		return nil, ErrExpiredToken
+	}
+
+	switch c.Status {
+	case DeviceCodeApproved:
+		redeemed, err := devices.Redeem(c)
+		if err != nil {
+			return nil, err
+		}
+		if !redeemed {
+			return nil, errors.ErrInvalidGrant
+		}
+		return c, nil
+	case DeviceCodeDenied:
+		devices.Delete(c)
+		return nil, ErrDeviceAccessDenied
+	}
+
+	tooFast := c.LastPolledAt != nil && now.Sub(*c.LastPolledAt) < time.Duration(c.Interval)*time.Second
+	if tooFast {
+		c.Interval += 5
+	}
+	c.LastPolledAt = &now
+	if err := devices.Poll(c); err != nil {
+		return nil, err
+	}
+	if tooFast {
+		return nil, ErrSlowDown
+	}
+	return nil, ErrAuthorizationPending
+}
+
+var deviceTemplate = template.Must(template.New("device").Parse(pageHead + `
+	{{if .Done}}
+	<h1>{{.Done}}</h1>
+	<p>You can return to your device.</p>
+	{{else if .ClientName}}
+	<h1>{{.ClientName}}</h1>
+	<p>Code <strong>{{.UserCode}}</strong> would like to:</p>
+	<ul>
+		{{range .Scopes}}<li>{{.}}</li>{{end}}
+	</ul>
+	<form method="post" action="/device">
+		<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+		<input type="hidden" name="user_code" value="{{.UserCode}}">
+		<button type="submit" name="action" value="approve">Allow</button>
+		<button type="submit" name="action" value="deny">Deny</button>
+	</form>
+	{{else}}
+	<h1>Connect a device</h1>
+	{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+	<form method="get" action="/device">
+		<label for="user_code">Enter the code shown on your device</label>
+		<input id="user_code" name="user_code" value="{{.UserCode}}" autocomplete="off" required autofocus>
+		<button type="submit">Continue</button>
+	</form>
+	{{end}}
+</body>
+</html>
+`))
+
+type devicePage struct {
+	Title      string
+	CSRFToken  string
+	UserCode   string
+	ClientName string
+	Scopes     []string
+	Error      string
+	Done       string
+}
+
+// deviceHandler lets the signed in user enter the user code and approve the device
+func deviceHandler(clients *ClientStore, consents *ConsentStore, devices *DeviceCodeStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store, err := session.Start(nil, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		uid, ok := store.Get("LoggedInUserID")
+		if !ok {
+			store.Set("ReturnUri", url.Values{"user_code": {r.FormValue("user_code")}})
+			store.Set("ReturnPath", "/device")
+			store.Save()
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+
+		page := devicePage{Title: "Connect a device", UserCode: r.FormValue("user_code")}
+		if page.UserCode == "" {
+			renderPage(w, deviceTemplate, http.StatusOK, page)
+			return
+		}
+
+		c, err := devices.GetByUserCode(page.UserCode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if c == nil || c.Status != DeviceCodePending || time.Now().After(c.ExpiresAt) {
+			page.Error = "The code is invalid or expired."
+			renderPage(w, deviceTemplate, http.StatusBadRequest, page)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			client, err := clients.Get(c.ClientID)
+			if err != nil || client == nil {
+				http.Error(w, "Unknown client", http.StatusBadRequest)
+				return
+			}
+			page.UserCode = formatUserCode(c.UserCode)
+			page.ClientName = client.ID
+			if name, ok := client.Metadata["client_name"].(string); ok && name != "" {
+				page.ClientName = name
+			}
+			page.Scopes = []string{}
+			for _, s := range strings.Fields(c.Scope) {
+				page.Scopes = append(page.Scopes, scopeDescription(s))
+			}
+			if page.CSRFToken, err = csrfToken(store); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			renderPage(w, deviceTemplate, http.StatusOK, page)
+		case http.MethodPost:
+			if !validCSRFToken(store, r) {
+				http.Error(w, "The form has expired, please try again", http.StatusForbidden)
+				return
+			}
+			c.UserID = uid.(string)
+			c.Status = DeviceCodeDenied
+			page.Done = "Device denied"
+			if r.PostFormValue("action") == "approve" {
+				if err := consents.Grant(c.UserID, c.ClientID, strings.Fields(c.Scope)); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				c.Status = DeviceCodeApproved
+				page.Done = "Device connected"
+			}
+			if err := devices.Update(c); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			renderPage(w, deviceTemplate, http.StatusOK, page)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
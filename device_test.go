@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+func TestVerifyDeviceCode(t *testing.T) {
+	devices := DeviceCodeStore{DB: database.NewDBWithString("sqlite3://:memory:")}
+	if err := devices.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	polled := time.Now()
+	for _, c := range []*DeviceCode{
+		{DeviceCodeHash: hashToken("approved"), UserCode: "A", ClientID: "tv", UserID: "u1", Status: DeviceCodeApproved, ExpiresAt: time.Now().Add(time.Minute)},
+		{DeviceCodeHash: hashToken("denied"), UserCode: "B", ClientID: "tv", Status: DeviceCodeDenied, ExpiresAt: time.Now().Add(time.Minute)},
+		{DeviceCodeHash: hashToken("pending"), UserCode: "C", ClientID: "tv", Status: DeviceCodePending, Interval: 5, ExpiresAt: time.Now().Add(time.Minute)},
+		{DeviceCodeHash: hashToken("fast"), UserCode: "D", ClientID: "tv", Status: DeviceCodePending, Interval: 5, LastPolledAt: &polled, ExpiresAt: time.Now().Add(time.Minute)},
+		{DeviceCodeHash: hashToken("expired"), UserCode: "E", ClientID: "tv", Status: DeviceCodeApproved, ExpiresAt: time.Now().Add(-time.Minute)},
+	} {
+		if err := devices.DB.Client().Create(c).Error; err != nil {
+			t.Fatalf("[%v] Failed to create device code", err)
+		}
+	}
+
+	cases := []struct {
+		name       string
+		deviceCode string
+		clientID   string
+		err        error
+	}{
+		{"other client", "approved", "other", errors.ErrInvalidGrant},
+		{"approved", "approved", "tv", nil},
+		{"approved twice", "approved", "tv", errors.ErrInvalidGrant},
+		{"denied", "denied", "tv", ErrDeviceAccessDenied},
+		{"pending", "pending", "tv", ErrAuthorizationPending},
+		{"polling too fast", "fast", "tv", ErrSlowDown},
+		{"expired", "expired", "tv", ErrExpiredToken},
+		{"unknown", "unknown", "tv", errors.ErrInvalidGrant},
+	}
+	for _, c := range cases {
+		form := url.Values{"device_code": {c.deviceCode}}
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		code, err := verifyDeviceCode(r, &devices, &Client{ID: c.clientID})
+		if err != c.err {
+			t.Errorf("[%s] expected %v, got %v", c.name, c.err, err)
+		}
+		if err == nil && (code == nil || code.UserID != "u1") {
+			t.Errorf("[%s] approved code should be returned, got %+v", c.name, code)
+		}
+	}
+}
+
+func TestDeviceCodeStoreRedeem(t *testing.T) {
+	devices := DeviceCodeStore{DB: database.NewDBWithString("sqlite3://:memory:")}
+	if err := devices.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	c := &DeviceCode{DeviceCodeHash: hashToken("approved"), UserCode: "A", ClientID: "tv", Status: DeviceCodeApproved, ExpiresAt: time.Now().Add(time.Minute)}
+	if err := devices.DB.Client().Create(c).Error; err != nil {
+		t.Fatalf("[%v] Failed to create device code", err)
+	}
+
+	// concurrent polls loaded the approved code before either redeemed it
+	if redeemed, err := devices.Redeem(c); err != nil || !redeemed {
+		t.Errorf("[%v] first poll should redeem the code", err)
+	}
+	if redeemed, err := devices.Redeem(c); err != nil || redeemed {
+		t.Errorf("[%v] second poll should not redeem the code again", err)
+	}
+
+	// the poll of a pending code must not overwrite the approval made meanwhile
+	pending := &DeviceCode{DeviceCodeHash: hashToken("pending"), UserCode: "B", ClientID: "tv", Status: DeviceCodePending, ExpiresAt: time.Now().Add(time.Minute)}
+	if err := devices.DB.Client().Create(pending).Error; err != nil {
+		t.Fatalf("[%v] Failed to create device code", err)
+	}
+	approved := *pending
+	approved.Status = DeviceCodeApproved
+	if err := devices.Update(&approved); err != nil {
+		t.Fatalf("[%v] Failed to approve device code", err)
+	}
+	now := time.Now()
+	pending.LastPolledAt = &now
+	if err := devices.Poll(pending); err != nil {
+		t.Fatalf("[%v] Failed to record poll", err)
+	}
+	if c, _ := devices.GetByDeviceCode("pending"); c == nil || c.Status != DeviceCodeApproved {
+		t.Errorf("approval should be kept, got %+v", c)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// OpenIDConfiguration OpenID Provider Metadata
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type OpenIDConfiguration struct {
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	UserInfoEndpoint                           string   `json:"userinfo_endpoint"`
+	JWKSURI                                    string   `json:"jwks_uri"`
+	ScopesSupported                            []string `json:"scopes_supported"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	ClaimsSupported                            []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
+	PromptValuesSupported                      []string `json:"prompt_values_supported"`
+
+	IntrospectionEndpoint                     string   `json:"introspection_endpoint"`
+	IntrospectionEndpointAuthMethodsSupported []string `json:"introspection_endpoint_auth_methods_supported"`
+	IntrospectionSigningAlgValuesSupported    []string `json:"introspection_signing_alg_values_supported"`
+	RevocationEndpoint                        string   `json:"revocation_endpoint"`
+	RevocationEndpointAuthMethodsSupported    []string `json:"revocation_endpoint_auth_methods_supported"`
+	RegistrationEndpoint                      string   `json:"registration_endpoint"`
+	DeviceAuthorizationEndpoint               string   `json:"device_authorization_endpoint"`
+	EndSessionEndpoint                        string   `json:"end_session_endpoint"`
+	TLSClientCertificateBoundAccessTokens     bool     `json:"tls_client_certificate_bound_access_tokens"`
+	DPoPSigningAlgValuesSupported             []string `json:"dpop_signing_alg_values_supported"`
+	PushedAuthorizationRequestEndpoint        string   `json:"pushed_authorization_request_endpoint"`
+	RequirePushedAuthorizationRequests        bool     `json:"require_pushed_authorization_requests"`
+	RequestParameterSupported                 bool     `json:"request_parameter_supported"`
+	RequestURIParameterSupported              bool     `json:"request_uri_parameter_supported"`
+	RequireRequestURIRegistration             bool     `json:"require_request_uri_registration"`
+	RequestObjectSigningAlgValuesSupported    []string `json:"request_object_signing_alg_values_supported"`
+	// MTLSEndpointAliases endpoints of the mutual TLS listener https://tools.ietf.org/html/rfc8705#section-5
+	MTLSEndpointAliases map[string]string `json:"mtls_endpoint_aliases,omitempty"`
+}
+
+// NewOpenIDConfiguration builds the discovery document from the server configuration
+func NewOpenIDConfiguration(srv *server.Server) *OpenIDConfiguration {
+	issuer := getIssuer()
+
+	responseTypes := []string{}
+	grantTypes := []string{}
+	for _, rt := range srv.Config.AllowedResponseTypes {
+		responseTypes = append(responseTypes, rt.String())
+		if rt == oauth2.Token {
+			grantTypes = append(grantTypes, "implicit")
+		}
+	}
+	for _, gt := range srv.Config.AllowedGrantTypes {
+		grantTypes = append(grantTypes, gt.String())
+	}
+	grantTypes = append(grantTypes, deviceCodeGrantType, tokenExchangeGrantType, jwtBearerGrantType)
+
+	return &OpenIDConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/authorize",
+		TokenEndpoint:                     issuer + "/token",
+		UserInfoEndpoint:                  issuer + "/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   standardScopes,
+		ResponseTypesSupported:            responseTypes,
+		GrantTypesSupported:               grantTypes,
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{idTokenSigningMethod.Alg()},
+		TokenEndpointAuthMethodsSupported: tokenEndpointAuthMethods,
+		TokenEndpointAuthSigningAlgValuesSupported: clientAssertionSigningAlgs,
+		ClaimsSupported:               claimNames(reflect.TypeOf(IDTokenClaims{})),
+		CodeChallengeMethodsSupported: []string{PKCEMethodS256, PKCEMethodPlain},
+		PromptValuesSupported:         []string{"none", "login", "consent"},
+
+		IntrospectionEndpoint:                     issuer + "/introspect",
+		IntrospectionEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "client_secret_jwt", "private_key_jwt", "tls_client_auth", "self_signed_tls_client_auth"},
+		IntrospectionSigningAlgValuesSupported:    []string{jwt.SigningMethodRS256.Alg()},
+		RevocationEndpoint:                        issuer + "/revoke",
+		RevocationEndpointAuthMethodsSupported:    []string{"client_secret_basic", "client_secret_post", "client_secret_jwt", "private_key_jwt", "tls_client_auth", "self_signed_tls_client_auth"},
+		RegistrationEndpoint:                      issuer + "/register",
+		DeviceAuthorizationEndpoint:               issuer + "/device_authorization",
+		EndSessionEndpoint:                        issuer + "/logout",
+		TLSClientCertificateBoundAccessTokens:     os.Getenv("TLS_PORT") != "",
+		DPoPSigningAlgValuesSupported:             dpopSigningAlgs,
+		PushedAuthorizationRequestEndpoint:        issuer + "/par",
+		RequestParameterSupported:                 true,
+		RequestURIParameterSupported:              true,
+		RequireRequestURIRegistration:             true,
+		RequestObjectSigningAlgValuesSupported:    clientAssertionSigningAlgs,
+		MTLSEndpointAliases:                       mtlsEndpointAliases(),
+	}
+}
+
+// mtlsEndpointAliases lists the endpoints with client authentication at MTLS_BASE_URL of the TLS listener
+func mtlsEndpointAliases() map[string]string {
+	base := os.Getenv("MTLS_BASE_URL")
+	if base == "" {
+		return nil
+	}
+	return map[string]string{
+		"token_endpoint":                        base + "/token",
+		"revocation_endpoint":                   base + "/revoke",
+		"introspection_endpoint":                base + "/introspect",
+		"device_authorization_endpoint":         base + "/device_authorization",
+		"userinfo_endpoint":                     base + "/userinfo",
+		"pushed_authorization_request_endpoint": base + "/par",
+	}
+}
+
+func discoveryHandler(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(NewOpenIDConfiguration(srv))
+	}
+}
+
+// getIssuer returns ISSUER_URL, it is required on startup, the host and scheme of the request are chosen by the caller
+// and not trusted for the iss of signed tokens
+func getIssuer() string {
+	return strings.TrimRight(os.Getenv("ISSUER_URL"), "/")
+}
+
+// claimNames lists json names of the struct fields including the embedded ones
+func claimNames(t reflect.Type) (names []string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			names = append(names, claimNames(f.Type)...)
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return
+}
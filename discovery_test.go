@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/server"
+)
+
+func TestGetIssuer(t *testing.T) {
+	defer os.Unsetenv("ISSUER_URL")
+
+	cases := []struct {
+		name      string
+		issuerURL string
+		expected  string
+	}{
+		{"configured", "https://auth.example.com/", "https://auth.example.com"},
+		{"path", "https://example.com/auth", "https://example.com/auth"},
+		{"missing", "", ""},
+	}
+	for _, c := range cases {
+		os.Setenv("ISSUER_URL", c.issuerURL)
+		if issuer := getIssuer(); issuer != c.expected {
+			t.Errorf("[%s] expected %s, got %s", c.name, c.expected, issuer)
+		}
+	}
+}
+
+func TestNewOpenIDConfiguration(t *testing.T) {
+	os.Setenv("ISSUER_URL", "https://auth.example.com")
+	defer os.Unsetenv("ISSUER_URL")
+
+	srv := server.NewDefaultServer(manage.NewDefaultManager())
+	c := NewOpenIDConfiguration(srv)
+
+	if c.Issuer != "https://auth.example.com" {
+		t.Errorf("issuer should be ISSUER_URL, got %s", c.Issuer)
+	}
+	if c.TokenEndpoint != "https://auth.example.com/token" || c.JWKSURI != "https://auth.example.com/.well-known/jwks.json" {
+		t.Errorf("endpoints should be under the issuer, got %s and %s", c.TokenEndpoint, c.JWKSURI)
+	}
+	if !database.StringList(c.ResponseTypesSupported).Contains("code") || !database.StringList(c.GrantTypesSupported).Contains("authorization_code") {
+		t.Errorf("server response and grant types should be listed, got %v and %v", c.ResponseTypesSupported, c.GrantTypesSupported)
+	}
+	if !database.StringList(c.ClaimsSupported).Contains("sub") || !database.StringList(c.ClaimsSupported).Contains("email") {
+		t.Errorf("claims should be read from IDTokenClaims, got %v", c.ClaimsSupported)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lestrrat/go-jwx/jwk"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// dpopSigningAlgs accepted for DPoP proofs, the key is public so only asymmetric algorithms are possible
+var dpopSigningAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// DPoPProofClaims https://datatracker.ietf.org/doc/html/rfc9449#section-4.2
+type DPoPProofClaims struct {
+	JTI   string `json:"jti"`
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	IAT   int64  `json:"iat"`
+	ATH   string `json:"ath,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// Valid the time and replay checks are done by verifyDPoPProof
+func (c *DPoPProofClaims) Valid() error {
+	return nil
+}
+
+type dpopKeyKey struct{}
+
+// dpopKeyFromRequest returns thumbprint of the key the token request proved, the token generator binds the token to it
+func dpopKeyFromRequest(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	jkt, _ := r.Context().Value(dpopKeyKey{}).(string)
+	return jkt
+}
+
+// withDPoPProof verifies the DPoP proof of the token request and keeps its key thumbprint in the request context
+func withDPoPProof(r *http.Request) (*http.Request, error) {
+	if len(r.Header["Dpop"]) == 0 {
+		return r, nil
+	}
+	jkt, err := verifyDPoPProof(r, "", dpopNonceLifetime() > 0)
+	if err != nil {
+		return nil, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), dpopKeyKey{}, jkt)), nil
+}
+
+// verifyDPoPProof checks the DPoP header of the request and returns thumbprint of its key,
+// accessToken is the token presented with the proof at the resource endpoints
+// https://datatracker.ietf.org/doc/html/rfc9449#section-4.3
+func verifyDPoPProof(r *http.Request, accessToken string, requireNonce bool) (string, error) {
+	proofs := r.Header["Dpop"]
+	if len(proofs) != 1 {
+		return "", ErrInvalidDPoPProof
+	}
+
+	var jkt string
+	claims := &DPoPProofClaims{}
+	parser := &jwt.Parser{ValidMethods: dpopSigningAlgs}
+	_, err := parser.ParseWithClaims(proofs[0], claims, func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, fmt.Errorf("typ has to be dpop+jwt")
+		}
+		data, err := json.Marshal(t.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		set, err := jwk.Parse(data)
+		if err != nil || len(set.Keys) != 1 {
+			return nil, fmt.Errorf("invalid jwk header")
+		}
+		key, err := set.Keys[0].Materialize()
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("jwk header has to be public key")
+		}
+		thumbprint, err := set.Keys[0].Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		jkt = base64.RawURLEncoding.EncodeToString(thumbprint)
+		return key, nil
+	})
+	if err != nil {
+		return "", ErrInvalidDPoPProof
+	}
+
+	base := listenerBaseURL(r)
+	if base == "" {
+		return "", fmt.Errorf("ISSUER_URL is not configured")
+	}
+	if claims.HTM != r.Method || claims.HTU != base+r.URL.Path || claims.JTI == "" {
+		return "", ErrInvalidDPoPProof
+	}
+	iat := time.Unix(claims.IAT, 0)
+	lifetime := dpopProofLifetime()
+	if time.Since(iat) > lifetime || time.Until(iat) > lifetime {
+		return "", ErrInvalidDPoPProof
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims.ATH != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", ErrInvalidDPoPProof
+		}
+	}
+	if requireNonce && !validDPoPNonce(claims.Nonce) {
+		return "", ErrUseDPoPNonce
+	}
+
+	if clientAssertions == nil {
+		return "", fmt.Errorf("DPoP proofs are not set up")
+	}
+	fresh, err := clientAssertions.Use("dpop:"+jkt, claims.JTI, iat.Add(lifetime))
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		securityEvent(r.Context(), "dpop_proof_replay", map[string]string{"jkt": jkt, "jti": claims.JTI})
+		return "", ErrInvalidDPoPProof
+	}
+	return jkt, nil
+}
+
+// dpopProofLifetime how old the proof may be, also the tolerated clock skew of its iat
+func dpopProofLifetime() time.Duration {
+	return time.Second * time.Duration(getEnvInt("DPOP_PROOF_LIFETIME", 300))
+}
+
+// dpopNonceLifetime how long the nonces provided by the server are accepted, zero disables nonces
+func dpopNonceLifetime() time.Duration {
+	return time.Second * time.Duration(getEnvInt("DPOP_NONCE_LIFETIME", 0))
+}
+
+// dpopNonceMAC signs the nonce time with key derived from the signing key, so every instance accepts the nonces
+func dpopNonceMAC(issuedAt []byte) ([]byte, error) {
+	key, _, err := getRSAKey()
+	if err != nil {
+		return nil, err
+	}
+	derived := sha256.Sum256(append([]byte("dpop-nonce:"), key.D.Bytes()...))
+	mac := hmac.New(sha256.New, derived[:])
+	mac.Write(issuedAt)
+	return mac.Sum(nil), nil
+}
+
+// newDPoPNonce https://datatracker.ietf.org/doc/html/rfc9449#section-8
+func newDPoPNonce() (string, error) {
+	issuedAt := make([]byte, 8)
+	binary.BigEndian.PutUint64(issuedAt, uint64(time.Now().Unix()))
+	mac, err := dpopNonceMAC(issuedAt)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(issuedAt, mac...)), nil
+}
+
+func validDPoPNonce(nonce string) bool {
+	data, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(data) != 8+sha256.Size {
+		return false
+	}
+	mac, err := dpopNonceMAC(data[:8])
+	if err != nil || !hmac.Equal(mac, data[8:]) {
+		return false
+	}
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0)
+	return time.Since(issuedAt) <= dpopNonceLifetime()
+}
+
+// setDPoPNonce provides fresh nonce with every token endpoint response when nonces are enabled
+func setDPoPNonce(w http.ResponseWriter) {
+	if dpopNonceLifetime() <= 0 {
+		return
+	}
+	if nonce, err := newDPoPNonce(); err == nil {
+		w.Header().Set("DPoP-Nonce", nonce)
+	}
+}
+
+// bindsRefreshToken returns key the refresh token is bound to, only refresh tokens of public clients are bound
+// https://datatracker.ietf.org/doc/html/rfc9449#section-5
+func bindsRefreshToken(r *http.Request, srv *server.Server, ti oauth2.TokenInfo) string {
+	jkt := dpopKeyFromRequest(r)
+	if jkt == "" {
+		return ""
+	}
+	cli, err := srv.Manager.GetClient(ti.GetClientID())
+	if err != nil {
+		return ""
+	}
+	if client, ok := cli.(*Client); ok && client.IsPublic() {
+		return jkt
+	}
+	return ""
+}
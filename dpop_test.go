@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/graphql-services/oauth/database"
+	"github.com/lestrrat/go-jwx/jwk"
+)
+
+func TestVerifyDPoPProof(t *testing.T) {
+	os.Setenv("ISSUER_URL", "https://auth.example.com")
+	os.Setenv("MTLS_BASE_URL", "https://mtls.auth.example.com")
+	os.Setenv("DPOP_NONCE_LIFETIME", "60")
+	defer os.Unsetenv("ISSUER_URL")
+	defer os.Unsetenv("MTLS_BASE_URL")
+	defer os.Unsetenv("DPOP_NONCE_LIFETIME")
+
+	clientAssertions = &AssertionStore{DB: database.NewDBWithString("sqlite3://:memory:")}
+	defer func() { clientAssertions = nil }()
+	if err := clientAssertions.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	// nonces are signed with key derived from the signing key
+	defer useTestSigningKey(t)()
+	nonce, err := newDPoPNonce()
+	if err != nil {
+		t.Fatalf("[%v] Failed to create nonce", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pk, _ := jwk.New(&key.PublicKey)
+	data, _ := json.Marshal(pk)
+	var header map[string]interface{}
+	json.Unmarshal(data, &header)
+	proof := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["typ"] = "dpop+jwt"
+		token.Header["jwk"] = header
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("[%v] Failed to sign proof", err)
+		}
+		return s
+	}
+	sum := sha256.Sum256([]byte("access-token"))
+	ath := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	cases := []struct {
+		name         string
+		url          string
+		tls          bool
+		claims       jwt.MapClaims
+		accessToken  string
+		requireNonce bool
+		err          error
+	}{
+		{"valid", "http://auth.example.com/token", false, jwt.MapClaims{}, "", false, nil},
+		{"wrong htm", "http://auth.example.com/token", false, jwt.MapClaims{"htm": "GET"}, "", false, ErrInvalidDPoPProof},
+		{"wrong htu", "http://auth.example.com/token", false, jwt.MapClaims{"htu": "https://auth.example.com/revoke"}, "", false, ErrInvalidDPoPProof},
+		{"htu of request host", "http://evil.example.com/token", false, jwt.MapClaims{"htu": "http://evil.example.com/token"}, "", false, ErrInvalidDPoPProof},
+		{"mtls listener", "https://localhost:8443/token", true, jwt.MapClaims{"htu": "https://mtls.auth.example.com/token"}, "", false, nil},
+		{"issuer htu at mtls listener", "https://localhost:8443/token", true, jwt.MapClaims{}, "", false, ErrInvalidDPoPProof},
+		{"stale iat", "http://auth.example.com/token", false, jwt.MapClaims{"iat": time.Now().Add(-time.Hour).Unix()}, "", false, ErrInvalidDPoPProof},
+		{"future iat", "http://auth.example.com/token", false, jwt.MapClaims{"iat": time.Now().Add(time.Hour).Unix()}, "", false, ErrInvalidDPoPProof},
+		{"ath", "http://auth.example.com/token", false, jwt.MapClaims{"ath": ath}, "access-token", false, nil},
+		{"ath mismatch", "http://auth.example.com/token", false, jwt.MapClaims{"ath": ath}, "other-token", false, ErrInvalidDPoPProof},
+		{"ath missing", "http://auth.example.com/token", false, jwt.MapClaims{}, "access-token", false, ErrInvalidDPoPProof},
+		{"nonce required", "http://auth.example.com/token", false, jwt.MapClaims{}, "", true, ErrUseDPoPNonce},
+		{"invalid nonce", "http://auth.example.com/token", false, jwt.MapClaims{"nonce": "abc"}, "", true, ErrUseDPoPNonce},
+		{"nonce", "http://auth.example.com/token", false, jwt.MapClaims{"nonce": nonce}, "", true, nil},
+	}
+	for _, tc := range cases {
+		claims := jwt.MapClaims{"jti": uuid.New().String(), "htm": "POST", "htu": "https://auth.example.com/token", "iat": time.Now().Unix()}
+		for k, v := range tc.claims {
+			claims[k] = v
+		}
+		r := httptest.NewRequest("POST", tc.url, nil)
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		r.Header.Set("DPoP", proof(claims))
+		if _, err := verifyDPoPProof(r, tc.accessToken, tc.requireNonce); err != tc.err {
+			t.Errorf("[%s] expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// the jti of the proof is accepted once
+	replayed := proof(jwt.MapClaims{"jti": "replayed", "htm": "POST", "htu": "https://auth.example.com/token", "iat": time.Now().Unix()})
+	for i, expected := range []error{nil, ErrInvalidDPoPProof} {
+		r := httptest.NewRequest("POST", "http://auth.example.com/token", nil)
+		r.Header.Set("DPoP", replayed)
+		if _, err := verifyDPoPProof(r, "", false); err != expected {
+			t.Errorf("[replay %d] expected %v, got %v", i, expected, err)
+		}
+	}
+}
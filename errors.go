@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	errs "errors"
+	"net/http"
+
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// errors with custom descriptions, the messages are the standard error codes
+var (
+	ErrCodeChallengeRequired          = errs.New("invalid_request")
+	ErrInvalidCodeChallenge           = errs.New("invalid_request")
+	ErrUnsupportedCodeChallengeMethod = errs.New("invalid_request")
+	ErrInvalidCodeVerifier            = errs.New("invalid_grant")
+
+	// https://tools.ietf.org/html/rfc8628#section-3.5
+	ErrAuthorizationPending = errs.New("authorization_pending")
+	ErrSlowDown             = errs.New("slow_down")
+	ErrExpiredToken         = errs.New("expired_token")
+	ErrDeviceAccessDenied   = errs.New("access_denied")
+
+	// https://tools.ietf.org/html/rfc8693#section-2.2.2
+	ErrInvalidTarget = errs.New("invalid_target")
+
+	// https://datatracker.ietf.org/doc/html/rfc9449#section-12.2
+	ErrInvalidDPoPProof = errs.New("invalid_dpop_proof")
+	ErrUseDPoPNonce     = errs.New("use_dpop_nonce")
+
+	// https://datatracker.ietf.org/doc/html/rfc9126#section-4
+	ErrInvalidRequestURI     = errs.New("invalid_request_uri")
+	ErrPushedRequestRequired = errs.New("invalid_request")
+
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthError
+	ErrLoginRequired   = errs.New("login_required")
+	ErrConsentRequired = errs.New("consent_required")
+
+	// https://datatracker.ietf.org/doc/html/rfc9101#section-6.3
+	ErrInvalidRequestObject = errs.New("invalid_request_object")
+)
+
+func init() {
+	registerError(ErrCodeChallengeRequired, "code_challenge is required for this client", http.StatusBadRequest)
+	registerError(ErrInvalidCodeChallenge, "code_challenge is missing or malformed", http.StatusBadRequest)
+	registerError(ErrUnsupportedCodeChallengeMethod, "code_challenge_method is not supported for this client", http.StatusBadRequest)
+	registerError(ErrInvalidCodeVerifier, "code_verifier does not match the code_challenge", http.StatusBadRequest)
+	registerError(ErrAuthorizationPending, "The user has not yet approved the device", http.StatusBadRequest)
+	registerError(ErrSlowDown, "The device is polling too fast, the interval is increased by 5 seconds", http.StatusBadRequest)
+	registerError(ErrExpiredToken, "The device_code has expired", http.StatusBadRequest)
+	registerError(ErrDeviceAccessDenied, "The user denied the device", http.StatusBadRequest)
+	registerError(ErrInvalidDPoPProof, "The DPoP proof is invalid or its key does not match", http.StatusBadRequest)
+	registerError(ErrUseDPoPNonce, "The DPoP proof has to use the nonce of the DPoP-Nonce header", http.StatusBadRequest)
+	registerError(ErrInvalidRequestURI, "The request_uri is unknown, expired or of another client", http.StatusBadRequest)
+	registerError(ErrPushedRequestRequired, "The client has to push the authorization request to the pushed_authorization_request_endpoint", http.StatusBadRequest)
+	registerError(ErrInvalidRequestObject, "The request object is invalid or not signed by the client", http.StatusBadRequest)
+	registerError(ErrLoginRequired, "The user has to sign in", http.StatusBadRequest)
+	registerError(ErrConsentRequired, "The user has to consent to the requested scopes", http.StatusBadRequest)
+	registerError(ErrInvalidTarget, "The requested audience or resource is unknown or not unique", http.StatusBadRequest)
+}
+
+// registerError makes the error known to the server so it is rendered with its description and status code
+func registerError(err error, description string, statusCode int) {
+	errors.Descriptions[err] = description
+	errors.StatusCodes[err] = statusCode
+}
+
+// writeErrorResponse writes the OAuth2 error response in the same format as the token endpoint
+func writeErrorResponse(w http.ResponseWriter, srv *server.Server, err error) {
+	data, statusCode, header := srv.GetErrorData(err)
+	for key := range header {
+		w.Header().Set(key, header.Get(key))
+	}
+	if err == errors.ErrInvalidClient {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+// securityEvent logs events which may mean an attack, one JSON line each so they can be alerted on
+func securityEvent(ctx context.Context, event string, fields map[string]string) {
+	data := map[string]string{"event": event}
+	for k, v := range fields {
+		data[k] = v
+	}
+	b, _ := json.Marshal(data)
+	log.Println("Security event:", string(b))
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag("security_event", event)
+		span.LogFields(otlog.String("security_event", string(b)))
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// https://tools.ietf.org/html/rfc8693#section-2.1
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	jwtTokenType           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// ActorClaim party acting on behalf of the subject, nested actors are the earlier steps of the delegation chain
+// https://tools.ietf.org/html/rfc8693#section-4.1
+type ActorClaim struct {
+	Subject string      `json:"sub"`
+	Actor   *ActorClaim `json:"act,omitempty"`
+}
+
+// tokenExchange claims of the exchanged token, the token generator gets them through the request context
+type tokenExchange struct {
+	Subject   string
+	Audience  string
+	Actor     *ActorClaim
+	ExpiresAt time.Time
+}
+
+type tokenExchangeKey struct{}
+
+func tokenExchangeFromRequest(r *http.Request) *tokenExchange {
+	if r == nil {
+		return nil
+	}
+	exchange, _ := r.Context().Value(tokenExchangeKey{}).(*tokenExchange)
+	return exchange
+}
+
+// tokenExchangeToken issues token of the subject token's user for the requested audience, the subject token
+// has to be issued to the requesting client. The requesting client is recorded as the actor, the party of the actor token acts on its behalf.
+// https://tools.ietf.org/html/rfc8693#section-2
+func tokenExchangeToken(r *http.Request, srv *server.Server, clients *ClientStore) (oauth2.TokenInfo, error) {
+	cli, err := authenticateClient(r, srv.Manager)
+	if err != nil {
+		return nil, err
+	}
+	if !cli.AllowsGrantType(oauth2.GrantType(tokenExchangeGrantType)) {
+		return nil, errors.ErrUnauthorizedClient
+	}
+	if t := r.PostFormValue("requested_token_type"); t != "" && t != accessTokenType {
+		return nil, errors.ErrInvalidRequest
+	}
+
+	subject, subjectClaims, err := loadExchangedToken(srv, r.PostFormValue("subject_token"), r.PostFormValue("subject_token_type"))
+	if err != nil {
+		return nil, err
+	}
+	// only the audience of the subject token can act on it, other clients could exchange any token they got hold of
+	if subjectClaims.Audience != cli.GetID() {
+		return nil, errors.ErrInvalidGrant
+	}
+	exchange := &tokenExchange{
+		Subject:   subjectClaims.Subject,
+		Actor:     &ActorClaim{Subject: cli.GetID(), Actor: subjectClaims.Actor},
+		ExpiresAt: subject.GetAccessCreateAt().Add(subject.GetAccessExpiresIn()),
+	}
+	if r.PostFormValue("actor_token") != "" || r.PostFormValue("actor_token_type") != "" {
+		_, actorClaims, err := loadExchangedToken(srv, r.PostFormValue("actor_token"), r.PostFormValue("actor_token_type"))
+		if err != nil {
+			return nil, err
+		}
+		// the requesting client stays in the chain unless it is the actor itself
+		if actorClaims.Subject != cli.GetID() {
+			exchange.Actor = &ActorClaim{Subject: actorClaims.Subject, Actor: exchange.Actor}
+		}
+	}
+	if exchange.Audience, err = exchangeAudience(r, clients); err != nil {
+		return nil, err
+	}
+
+	// the exchanged token can only narrow the scope of the subject token
+	scope := r.PostFormValue("scope")
+	if scope == "" {
+		scope = subjectClaims.Scope
+	}
+	for _, s := range strings.Fields(scope) {
+		if !containsScope(subjectClaims.Scope, s) {
+			return nil, errors.ErrInvalidScope
+		}
+	}
+	if !cli.AllowsScope(scope) {
+		return nil, errors.ErrInvalidScope
+	}
+
+	// the client credentials config issues no refresh token, the exchanged token can not outlive the subject token
+	ctx := context.WithValue(r.Context(), tokenExchangeKey{}, exchange)
+	return srv.Manager.GenerateAccessToken(oauth2.ClientCredentials, &oauth2.TokenGenerateRequest{
+		ClientID:     cli.GetID(),
+		ClientSecret: cli.GetSecret(),
+		UserID:       subject.GetUserID(),
+		Scope:        scope,
+		Request:      r.WithContext(ctx),
+	})
+}
+
+// loadExchangedToken loads active access token issued by this server with its claims
+func loadExchangedToken(srv *server.Server, token, tokenType string) (oauth2.TokenInfo, *JWTAccessClaims, error) {
+	if token == "" || (tokenType != accessTokenType && tokenType != jwtTokenType) {
+		return nil, nil, errors.ErrInvalidRequest
+	}
+	ti, err := srv.Manager.LoadAccessToken(token)
+	if err != nil {
+		return nil, nil, errors.ErrInvalidGrant
+	}
+	claims, err := accessTokenClaims(ti)
+	if err != nil {
+		return nil, nil, errors.ErrInvalidGrant
+	}
+	return ti, claims, nil
+}
+
+// exchangeAudience returns the target of the exchanged token, audience has to be registered client
+// and resource an absolute URI. The token has a single aud claim, so only one target is accepted.
+func exchangeAudience(r *http.Request, clients *ClientStore) (string, error) {
+	audiences, resources := r.PostForm["audience"], r.PostForm["resource"]
+	switch {
+	case len(audiences)+len(resources) == 0:
+		return "", nil
+	case len(audiences)+len(resources) > 1:
+		return "", ErrInvalidTarget
+	case len(audiences) == 1:
+		c, err := clients.Get(audiences[0])
+		if err != nil {
+			return "", err
+		}
+		if c == nil || c.Disabled {
+			return "", ErrInvalidTarget
+		}
+		return c.ID, nil
+	}
+	u, err := url.Parse(resources[0])
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return "", ErrInvalidTarget
+	}
+	return resources[0], nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/models"
+	"gopkg.in/oauth2.v3/server"
+	"gopkg.in/oauth2.v3/store"
+)
+
+func TestTokenExchangeToken(t *testing.T) {
+	defer useTestSigningKey(t)()
+
+	id := newTestIDServer()
+	defer id.Close()
+	db := database.NewDBWithString("sqlite3://:memory:")
+	users := UserStore{DB: db, ID: &IDClient{URL: id.URL}}
+	clients := ClientStore{DB: db}
+	for _, migrate := range []func() error{users.AutoMigrate, clients.AutoMigrate} {
+		if err := migrate(); err != nil {
+			t.Fatalf("[%v] Failed to automigrate", err)
+		}
+	}
+	user, err := users.CreateUserWithAccount(context.Background(), "abcd1234", "john.doe@example.com", "idp")
+	if err != nil {
+		t.Fatalf("[%v] Failed to create user", err)
+	}
+	for _, cli := range []*Client{
+		{ID: "api", GrantTypes: database.StringList{tokenExchangeGrantType}},
+		{ID: "web"},
+		{ID: "svc"},
+	} {
+		if err := cli.SetSecret("secret"); err != nil {
+			t.Fatalf("[%v] Failed to set secret", err)
+		}
+		if err := clients.Create(cli); err != nil {
+			t.Fatalf("[%v] Failed to create client", err)
+		}
+	}
+
+	m := manage.NewDefaultManager()
+	m.MapClientStorage(&clients)
+	tokens, _ := store.NewMemoryTokenStore()
+	m.MapTokenStorage(tokens)
+	m.MapAccessGenerate(NewJWTAccessGenerate(jwt.SigningMethodRS256, &users))
+	srv := server.NewDefaultServer(m)
+
+	toAPI := createTestAccessToken(t, tokens, &models.Token{ClientID: "api", UserID: user.ID, Scope: "openid"}, nil)
+	toWeb := createTestAccessToken(t, tokens, &models.Token{ClientID: "web", UserID: user.ID, Scope: "openid"}, nil)
+	delegated := createTestAccessToken(t, tokens, &models.Token{ClientID: "api", UserID: user.ID, Scope: "openid"}, &JWTAccessClaims{Actor: &ActorClaim{Subject: "web"}})
+	svc := createTestAccessToken(t, tokens, &models.Token{ClientID: "svc", Scope: "openid"}, nil)
+	own := createTestAccessToken(t, tokens, &models.Token{ClientID: "api", Scope: "openid"}, nil)
+
+	cases := []struct {
+		name         string
+		clientID     string
+		subjectToken string
+		actorToken   string
+		actor        *ActorClaim
+		err          error
+	}{
+		{"subject token of the client", "api", toAPI, "", &ActorClaim{Subject: "api"}, nil},
+		{"subject token of other client", "api", toWeb, "", nil, errors.ErrInvalidGrant},
+		{"grant type not listed", "web", toWeb, "", nil, errors.ErrUnauthorizedClient},
+		{"earlier actors", "api", delegated, "", &ActorClaim{Subject: "api", Actor: &ActorClaim{Subject: "web"}}, nil},
+		{"actor token", "api", toAPI, svc, &ActorClaim{Subject: "svc", Actor: &ActorClaim{Subject: "api"}}, nil},
+		{"actor token of the client", "api", toAPI, own, &ActorClaim{Subject: "api"}, nil},
+	}
+	for _, c := range cases {
+		form := url.Values{"grant_type": {tokenExchangeGrantType}, "subject_token": {c.subjectToken}, "subject_token_type": {accessTokenType}}
+		if c.actorToken != "" {
+			form.Set("actor_token", c.actorToken)
+			form.Set("actor_token_type", accessTokenType)
+		}
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(c.clientID, "secret")
+		ti, err := tokenExchangeToken(r, srv, &clients)
+		if err != c.err {
+			t.Errorf("[%s] expected %v, got %v", c.name, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		claims, err := accessTokenClaims(ti)
+		if err != nil {
+			t.Fatalf("[%v] Failed to decode exchanged token", err)
+		}
+		if claims.Subject != user.ID || !reflect.DeepEqual(claims.Actor, c.actor) {
+			t.Errorf("[%s] expected sub %s and act %+v, got %s and %+v", c.name, user.ID, c.actor, claims.Subject, claims.Actor)
+		}
+	}
+}
+
+func TestClientAllowsDelegationGrantTypes(t *testing.T) {
+	unrestricted := &Client{ID: "unrestricted"}
+	for _, gt := range []string{tokenExchangeGrantType, jwtBearerGrantType} {
+		if unrestricted.AllowsGrantType(oauth2.GrantType(gt)) {
+			t.Errorf("[%s] empty grant types should not allow it", gt)
+		}
+		if !(&Client{ID: "listed", GrantTypes: database.StringList{gt}}).AllowsGrantType(oauth2.GrantType(gt)) {
+			t.Errorf("[%s] listed grant type should be allowed", gt)
+		}
+	}
+	if !unrestricted.AllowsGrantType(oauth2.GrantType("authorization_code")) {
+		t.Errorf("empty grant types should allow the other grant types")
+	}
+}
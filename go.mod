@@ -21,6 +21,7 @@ require (
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/rs/cors v1.7.0
 	github.com/techknowlogick/go-oauth2-gorm v0.0.0-20190227022023-58d20c86482c
+	golang.org/x/crypto v0.0.0-20190605123033-f99c8df09eb5
 	google.golang.org/api v0.10.0
 	google.golang.org/grpc v1.23.1
 	gopkg.in/oauth2.v3 v3.10.1
@@ -29,6 +29,9 @@ query($id: ID!) {
 		birthdate
 		zoneinfo
 		locale
+		phone_number
+		phone_number_verified
+		address
 		updatedAt
 	}
 }  
@@ -60,7 +63,7 @@ type User struct {
 	Zoneinfo            *string    `json:"zoneinfo"`
 	Locale              *string    `json:"locale"`
 	PhoneNumber         *string    `json:"phone_number"`
-	PhoneNumberVerified *string    `json:"phone_number_verified"`
+	PhoneNumberVerified *bool      `json:"phone_number_verified"`
 	Address             *string    `json:"address"`
 	UpdatedAt           *time.Time `json:"updatedAt"`
 	CreatedAt           time.Time  `json:"createdAt"`
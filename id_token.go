@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"log"
+	"net/http"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/patrickmn/go-cache"
 	"gopkg.in/oauth2.v3"
 	"gopkg.in/oauth2.v3/errors"
 )
@@ -30,6 +35,26 @@ type IDTokenEmailClaims struct {
 	Email         string `json:"email,omitempty"`
 	EmailVerified bool   `json:"email_verified,omitempty"`
 }
+type IDTokenPhoneClaims struct {
+	PhoneNumber         *string `json:"phone_number,omitempty"`
+	PhoneNumberVerified *bool   `json:"phone_number_verified,omitempty"`
+}
+type IDTokenAddressClaims struct {
+	Address *AddressClaim `json:"address,omitempty"`
+}
+
+// AddressClaim https://openid.net/specs/openid-connect-core-1_0.html#AddressClaim
+type AddressClaim struct {
+	Formatted string `json:"formatted"`
+}
+
+// IDTokenUserClaims claims about the user released according to the granted scopes
+type IDTokenUserClaims struct {
+	IDTokenEmailClaims
+	IDTokenProfileClaims
+	IDTokenPhoneClaims
+	IDTokenAddressClaims
+}
 
 type IDTokenClaims struct {
 	Audience  string `json:"aud,omitempty"`
@@ -37,20 +62,125 @@ type IDTokenClaims struct {
 	IssuedAt  int64  `json:"iat,omitempty"`
 	Issuer    string `json:"iss,omitempty"`
 	Subject   string `json:"sub,omitempty"`
-	IDTokenEmailClaims
-	IDTokenProfileClaims
+	// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+	Nonce           string `json:"nonce,omitempty"`
+	AuthTime        int64  `json:"auth_time,omitempty"`
+	AccessTokenHash string `json:"at_hash,omitempty"`
+	CodeHash        string `json:"c_hash,omitempty"`
+	// SessionID hash of the session the user signed in with, see logout.go
+	SessionID string `json:"sid,omitempty"`
+	IDTokenUserClaims
+}
+
+// Authentication of the user the ID token is issued for, it travels from /authorize with the code
+type Authentication struct {
+	Issuer    string
+	Nonce     string
+	AuthTime  int64
+	SessionID string
+	// Code the tokens are issued for, only set at the token endpoint
+	Code string
+}
+
+type authenticationKey struct{}
+
+func withAuthentication(r *http.Request, a *Authentication) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authenticationKey{}, a))
 }
 
-func generateIDToken(ctx context.Context, ti oauth2.TokenInfo, us *UserStore) (token string, err error) {
+func authenticationFromRequest(r *http.Request) *Authentication {
+	if r == nil {
+		return nil
+	}
+	a, _ := r.Context().Value(authenticationKey{}).(*Authentication)
+	return a
+}
+
+// pendingAuthentications hands the authentication over from the token generator, which sees the request,
+// to the ExtensionFieldsHandler, which gets only the issued token
+var pendingAuthentications = cache.New(time.Minute, time.Minute)
+
+// rememberAuthentication keeps the authentication of the request for the ID token of the access token
+func rememberAuthentication(r *http.Request, accessToken string) {
+	if r == nil {
+		return
+	}
+	a := Authentication{}
+	if auth := authenticationFromRequest(r); auth != nil {
+		a = *auth
+	}
+	a.Issuer = getIssuer()
+	pendingAuthentications.Set(accessToken, &a, cache.DefaultExpiration)
+}
+
+// takeAuthentication returns the authentication remembered for the access token
+func takeAuthentication(accessToken string) *Authentication {
+	v, ok := pendingAuthentications.Get(accessToken)
+	if !ok {
+		return &Authentication{}
+	}
+	pendingAuthentications.Delete(accessToken)
+	return v.(*Authentication)
+}
+
+// tokenHash left half of SHA-256 of the token, the hash of at_hash and c_hash for RS256
+// https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+// idTokenSigningMethod is the algorithm used to sign ID tokens
+var idTokenSigningMethod = jwt.SigningMethodRS256
+
+// idTokenFieldsHandler adds the id_token to token responses of openid requests,
+// tokens without user are issued to the client itself, there is nobody to identify
+func idTokenFieldsHandler(us *UserStore) func(ti oauth2.TokenInfo) map[string]interface{} {
+	return func(ti oauth2.TokenInfo) map[string]interface{} {
+		if !containsScope(ti.GetScope(), "openid") || ti.GetUserID() == "" {
+			return nil
+		}
+		idToken, err := generateIDToken(context.Background(), ti, us, takeAuthentication(ti.GetAccess()))
+		if err != nil {
+			// the library can not fail the response here, the token is issued without id_token
+			log.Println("Failed to generate id_token:", err)
+			return nil
+		}
+		return map[string]interface{}{"id_token": idToken}
+	}
+}
+
+func generateIDToken(ctx context.Context, ti oauth2.TokenInfo, us *UserStore, auth *Authentication) (token string, err error) {
 	user, err := us.GetUser(ctx, ti.GetUserID())
-	scope := ti.GetScope()
+	if err != nil {
+		return
+	}
+	if user == nil {
+		err = fmt.Errorf("user %s not found", ti.GetUserID())
+		return
+	}
 
 	claims := &IDTokenClaims{
-		Audience:  ti.GetClientID(),
-		Subject:   user.ID,
-		ExpiresAt: ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn()).Unix(),
+		Audience:          ti.GetClientID(),
+		Subject:           user.ID,
+		Issuer:            auth.Issuer,
+		IssuedAt:          time.Now().Unix(),
+		ExpiresAt:         ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn()).Unix(),
+		Nonce:             auth.Nonce,
+		AuthTime:          auth.AuthTime,
+		SessionID:         auth.SessionID,
+		AccessTokenHash:   tokenHash(ti.GetAccess()),
+		IDTokenUserClaims: newIDTokenUserClaims(user, ti.GetScope()),
+	}
+	if auth.Code != "" {
+		claims.CodeHash = tokenHash(auth.Code)
 	}
 
+	token, err = signToken(jwt.NewWithClaims(idTokenSigningMethod, claims))
+	return
+}
+
+func newIDTokenUserClaims(user *User, scope string) (claims IDTokenUserClaims) {
 	if containsScope(scope, "email") {
 		claims.IDTokenEmailClaims = IDTokenEmailClaims{
 			Email:         user.Email,
@@ -79,15 +209,17 @@ func generateIDToken(ctx context.Context, ti oauth2.TokenInfo, us *UserStore) (t
 			UpdatedAt:         user.UpdatedAt,
 		}
 	}
-
-	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	signedKey, kid, err := getRSAKey()
-	if err != nil {
-		return
+	if containsScope(scope, "phone") {
+		claims.IDTokenPhoneClaims = IDTokenPhoneClaims{
+			PhoneNumber:         user.PhoneNumber,
+			PhoneNumberVerified: user.PhoneNumberVerified,
+		}
+	}
+	if containsScope(scope, "address") && user.Address != nil {
+		claims.IDTokenAddressClaims = IDTokenAddressClaims{
+			Address: &AddressClaim{Formatted: *user.Address},
+		}
 	}
-	t.Header["kid"] = kid
-	token, err = t.SignedString(signedKey)
-
 	return
 }
 
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/graphql-services/oauth/database"
+	"github.com/patrickmn/go-cache"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// useTestSigningKey replaces the key of JWKS_PROVIDER_URL, the returned func restores it
+func useTestSigningKey(t *testing.T) func() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("[%v] Failed to generate signing key", err)
+	}
+	c = cache.New(time.Minute, time.Minute)
+	c.Set("rsaKey", key, cache.DefaultExpiration)
+	c.Set("rsaKeyKid", "test", cache.DefaultExpiration)
+	rememberPublicKey("test", &key.PublicKey)
+	return func() {
+		c = nil
+		publicKeys.Delete("test")
+	}
+}
+
+// https://openid.net/specs/openid-connect-core-1_0.html#code-id_tokenExample
+func TestTokenHash(t *testing.T) {
+	cases := []struct {
+		token string
+		hash  string
+	}{
+		{"jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y", "77QmUPtjPfzWtF2AnpK9RQ"},
+		{"Qcb0Orv1zh30vL1MPRsbm-diHiMwcLyZvn1arpZv-Jxf_11jnpEX3Tgfvk", "LDktKdoQak3Pk0cnXxCltA"},
+	}
+	for _, c := range cases {
+		if hash := tokenHash(c.token); hash != c.hash {
+			t.Errorf("%s: expected hash %s, got %s", c.token, c.hash, hash)
+		}
+	}
+}
+
+func TestIDTokenFieldsHandler(t *testing.T) {
+	defer useTestSigningKey(t)()
+
+	id := newTestIDServer()
+	defer id.Close()
+	users := UserStore{DB: database.NewDBWithString("sqlite3://:memory:"), ID: &IDClient{URL: id.URL}}
+	if err := users.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	user, err := users.CreateUserWithAccount(context.Background(), "abcd1234", "john.doe@example.com", "idp")
+	if err != nil {
+		t.Fatalf("[%v] Failed to create user", err)
+	}
+	handler := idTokenFieldsHandler(&users)
+
+	cases := []struct {
+		name    string
+		userID  string
+		scope   string
+		idToken bool
+	}{
+		{"openid", user.ID, "openid email", true},
+		{"without openid scope", user.ID, "email", false},
+		{"client credentials", "", "openid", false},
+		// the failure is logged and the response is written without id_token instead of a panic
+		{"deleted user", "deleted", "openid", false},
+	}
+	for _, c := range cases {
+		ti := &models.Token{ClientID: "app", UserID: c.userID, Scope: c.scope, Access: "access-" + c.name, AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour}
+		fields := handler(ti)
+		if _, ok := fields["id_token"]; ok != c.idToken {
+			t.Errorf("[%s] expected id_token %v, got %v", c.name, c.idToken, fields)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+const introspectionJWTContentType = "application/token-introspection+jwt"
+
+// IntrospectionResponse https://tools.ietf.org/html/rfc7662#section-2.2
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  string   `json:"aud,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	User      *JWTUser `json:"user,omitempty"`
+	// Actor of exchanged tokens https://tools.ietf.org/html/rfc8693#section-4.1
+	Actor *ActorClaim `json:"act,omitempty"`
+	// Confirmation of certificate bound tokens https://tools.ietf.org/html/rfc8705#section-3.2
+	Confirmation *ConfirmationClaim `json:"cnf,omitempty"`
+}
+
+// IntrospectionJWTClaims claims of the signed introspection response
+// https://tools.ietf.org/html/rfc9701#section-5
+type IntrospectionJWTClaims struct {
+	TokenIntrospection *IntrospectionResponse `json:"token_introspection"`
+	jwt.StandardClaims
+}
+
+func introspectionHandler(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		cli, err := authenticateClient(r, srv.Manager)
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+
+		token := r.PostFormValue("token")
+		if token == "" {
+			writeErrorResponse(w, srv, errors.ErrInvalidRequest)
+			return
+		}
+
+		res := introspectToken(srv.Manager, token, r.PostFormValue("token_type_hint"))
+		if res.Active {
+			res.Issuer = getIssuer()
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+
+		if strings.Contains(r.Header.Get("Accept"), introspectionJWTContentType) {
+			t := jwt.NewWithClaims(jwt.SigningMethodRS256, &IntrospectionJWTClaims{
+				TokenIntrospection: res,
+				StandardClaims: jwt.StandardClaims{
+					Issuer:   getIssuer(),
+					Audience: cli.GetID(),
+					IssuedAt: time.Now().Unix(),
+				},
+			})
+			t.Header["typ"] = "token-introspection+jwt"
+			signed, err := signToken(t)
+			if err != nil {
+				writeErrorResponse(w, srv, err)
+				return
+			}
+			w.Header().Set("Content-Type", introspectionJWTContentType)
+			w.Write([]byte(signed))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// introspectToken looks the token up in the token store, unknown, expired and revoked tokens are inactive
+func introspectToken(manager oauth2.Manager, token, hint string) *IntrospectionResponse {
+	if hint != "refresh_token" {
+		if ti, err := manager.LoadAccessToken(token); err == nil {
+			return newAccessTokenIntrospection(ti)
+		}
+	}
+	if ti, err := manager.LoadRefreshToken(token); err == nil {
+		return &IntrospectionResponse{
+			Active:    true,
+			Scope:     ti.GetScope(),
+			ClientID:  ti.GetClientID(),
+			TokenType: "refresh_token",
+			Subject:   ti.GetUserID(),
+			IssuedAt:  ti.GetRefreshCreateAt().Unix(),
+			ExpiresAt: ti.GetRefreshCreateAt().Add(ti.GetRefreshExpiresIn()).Unix(),
+		}
+	}
+	if hint == "refresh_token" {
+		if ti, err := manager.LoadAccessToken(token); err == nil {
+			return newAccessTokenIntrospection(ti)
+		}
+	}
+	return &IntrospectionResponse{Active: false}
+}
+
+func newAccessTokenIntrospection(ti oauth2.TokenInfo) *IntrospectionResponse {
+	res := &IntrospectionResponse{
+		Active:    true,
+		Scope:     ti.GetScope(),
+		ClientID:  ti.GetClientID(),
+		TokenType: "Bearer",
+		Subject:   ti.GetUserID(),
+		Audience:  ti.GetClientID(),
+		IssuedAt:  ti.GetAccessCreateAt().Unix(),
+		ExpiresAt: ti.GetAccessCreateAt().Add(ti.GetAccessExpiresIn()).Unix(),
+	}
+
+	if claims, err := accessTokenClaims(ti); err == nil {
+		res.Scope = claims.Scope
+		res.Subject = claims.Subject
+		res.Audience = claims.Audience
+		res.Actor = claims.Actor
+		res.Confirmation = claims.Confirmation
+		if claims.User != nil && claims.User.Email != "" {
+			res.Username = claims.User.Email
+			res.User = &JWTUser{Email: claims.User.Email}
+		}
+	}
+	return res
+}
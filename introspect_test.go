@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/models"
+	"gopkg.in/oauth2.v3/server"
+	"gopkg.in/oauth2.v3/store"
+)
+
+func TestIntrospectionHandler(t *testing.T) {
+	defer useTestSigningKey(t)()
+
+	db := database.NewDBWithString("sqlite3://:memory:")
+	clients := ClientStore{DB: db}
+	if err := clients.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	confidential := &Client{ID: "api"}
+	if err := confidential.SetSecret("secret"); err != nil {
+		t.Fatalf("[%v] Failed to set secret", err)
+	}
+	for _, cli := range []*Client{confidential, {ID: "spa"}} {
+		if err := clients.Create(cli); err != nil {
+			t.Fatalf("[%v] Failed to create client", err)
+		}
+	}
+
+	m := manage.NewDefaultManager()
+	m.MapClientStorage(&clients)
+	tokens, _ := store.NewMemoryTokenStore()
+	m.MapTokenStorage(tokens)
+	handler := introspectionHandler(server.NewDefaultServer(m))
+	access := createTestAccessToken(t, tokens, &models.Token{ClientID: "spa", UserID: "u1", Scope: "openid"}, nil)
+
+	cases := []struct {
+		name       string
+		clientID   string
+		secret     string
+		statusCode int
+	}{
+		{"confidential client", "api", "secret", http.StatusOK},
+		{"public client", "spa", "", http.StatusUnauthorized},
+		{"public client with client_id of confidential client", "api", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		form := url.Values{"token": {access}, "client_id": {c.clientID}}
+		if c.secret != "" {
+			form.Set("client_secret", c.secret)
+		}
+		r := httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.statusCode {
+			t.Errorf("[%s] expected %d, got %d", c.name, c.statusCode, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var res IntrospectionResponse
+		json.NewDecoder(w.Body).Decode(&res)
+		if !res.Active || res.ClientID != "spa" || res.Subject != "u1" {
+			t.Errorf("[%s] unexpected introspection %+v", c.name, res)
+		}
+	}
+}
@@ -3,10 +3,14 @@ package main
 
 import (
 	"crypto/rsa"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
+	"sort"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/lestrrat/go-jwx/jwk"
 	"github.com/patrickmn/go-cache"
 )
@@ -18,6 +22,9 @@ type RSAKey struct {
 
 var c *cache.Cache
 
+// publicKeys keeps public halves of signing keys by kid, rotated keys expire after the grace period
+var publicKeys = cache.New(cache.NoExpiration, 10*time.Minute)
+
 // get RSA Key with caching
 func getRSAKey() (key *rsa.PrivateKey, kid string, err error) {
 	if c == nil {
@@ -51,8 +58,7 @@ func fetchRSAKey() (key *rsa.PrivateKey, kid string, err error) {
 		return
 	}
 
-	// If you KNOW you have exactly one key, you can just
-	// use set.Keys[0]
+	// the first key is used for signing, the others are published for verification only
 	keys := set.Keys
 	if len(keys) == 0 {
 		err = fmt.Errorf("failed to lookup key: %s", err)
@@ -67,6 +73,92 @@ func fetchRSAKey() (key *rsa.PrivateKey, kid string, err error) {
 	key, ok := _key.(*rsa.PrivateKey)
 	if !ok {
 		err = fmt.Errorf("Cannot convert key to RSA Private Key")
+		return
+	}
+
+	for _, k := range keys {
+		_k, mErr := k.Materialize()
+		if mErr != nil {
+			continue
+		}
+		if pk, ok := _k.(*rsa.PrivateKey); ok {
+			rememberPublicKey(k.KeyID(), &pk.PublicKey)
+		}
 	}
 	return
 }
+
+// signToken signs the token with the active RSA key
+func signToken(t *jwt.Token) (signed string, err error) {
+	key, kid, err := getRSAKey()
+	if err != nil {
+		return
+	}
+	t.Header["kid"] = kid
+	return t.SignedString(key)
+}
+
+func rememberPublicKey(kid string, key *rsa.PublicKey) {
+	grace := time.Second * time.Duration(getEnvInt("JWKS_ROTATION_GRACE_PERIOD", 86400))
+	publicKeys.Set(kid, key, grace)
+}
+
+// getPublicKey returns public key of active or recently rotated signing key
+func getPublicKey(kid string) (key *rsa.PublicKey, err error) {
+	if _, _, err = getRSAKey(); err != nil {
+		return
+	}
+	v, ok := publicKeys.Get(kid)
+	if !ok {
+		err = fmt.Errorf("unknown key %s", kid)
+		return
+	}
+	key = v.(*rsa.PublicKey)
+	return
+}
+
+// getPublicJWKS returns public keys in JWK set, the active signing key goes first
+func getPublicJWKS() (set *jwk.Set, err error) {
+	_, activeKid, err := getRSAKey()
+	if err != nil {
+		return
+	}
+
+	items := publicKeys.Items()
+	kids := []string{}
+	for kid := range items {
+		kids = append(kids, kid)
+	}
+	sort.Slice(kids, func(i, j int) bool {
+		if kids[i] == activeKid || kids[j] == activeKid {
+			return kids[i] == activeKid
+		}
+		return kids[i] < kids[j]
+	})
+
+	set = &jwk.Set{Keys: []jwk.Key{}}
+	for _, kid := range kids {
+		k, kErr := jwk.New(items[kid].Object.(*rsa.PublicKey))
+		if kErr != nil {
+			err = kErr
+			return
+		}
+		k.Set(jwk.KeyIDKey, kid)
+		k.Set(jwk.AlgorithmKey, jwt.SigningMethodRS256.Alg())
+		k.Set(jwk.KeyUsageKey, string(jwk.ForSignature))
+		set.Keys = append(set.Keys, k)
+	}
+	return
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	set, err := getPublicJWKS()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", getEnvInt("JWKS_MAX_AGE", 300)))
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/rsa"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestAccessTokenVerifiesWithJWKS(t *testing.T) {
+	defer useTestSigningKey(t)()
+
+	ti := models.NewToken()
+	ti.SetAccessCreateAt(time.Now())
+	ti.SetAccessExpiresIn(time.Hour)
+	data := &oauth2.GenerateBasic{
+		Client:    &Client{ID: "app"},
+		CreateAt:  time.Now(),
+		TokenInfo: ti,
+		Request:   httptest.NewRequest("POST", "http://localhost:8080/token", nil),
+	}
+	access, _, err := NewJWTAccessGenerate(jwt.SigningMethodRS256, nil).Token(data, false)
+	if err != nil {
+		t.Fatalf("[%v] Failed to generate access token", err)
+	}
+
+	set, err := getPublicJWKS()
+	if err != nil {
+		t.Fatalf("[%v] Failed to get JWKS", err)
+	}
+	claims := &JWTAccessClaims{}
+	token, err := jwt.ParseWithClaims(access, claims, func(token *jwt.Token) (interface{}, error) {
+		keys := set.LookupKeyID(token.Header["kid"].(string))
+		if len(keys) == 0 {
+			t.Fatalf("kid %v of the access token is not published", token.Header["kid"])
+		}
+		key, err := keys[0].Materialize()
+		if err != nil {
+			return nil, err
+		}
+		return key.(*rsa.PublicKey), nil
+	})
+	if err != nil || !token.Valid {
+		t.Fatalf("[%v] access token should verify with the published key", err)
+	}
+	if claims.Subject != "app" || claims.Audience != "app" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
@@ -3,12 +3,9 @@ package main
 import (
 	"context"
 	"encoding/base64"
-	"fmt"
 	"strings"
 	"time"
 
-	errs "errors"
-
 	"github.com/dgrijalva/jwt-go"
 	opentracing "github.com/opentracing/opentracing-go"
 	"gopkg.in/oauth2.v3"
@@ -20,13 +17,24 @@ type JWTUser struct {
 	Email string `json:"email"`
 }
 
-// JWTAccessClaims jwt claims
+// JWTAccessClaims jwt claims, tokens of the client credentials grant have no user
 type JWTAccessClaims struct {
-	Scope string  `json:"scope"`
-	User  JWTUser `json:"user"`
+	Scope     string   `json:"scope"`
+	User      *JWTUser `json:"user,omitempty"`
+	GrantType string   `json:"gty,omitempty"`
+	// Actor of exchanged tokens, see exchange.go
+	Actor *ActorClaim `json:"act,omitempty"`
+	// Confirmation of certificate bound tokens, see mtls.go
+	Confirmation *ConfirmationClaim `json:"cnf,omitempty"`
 	jwt.StandardClaims
 }
 
+// accessTokenJWTType typ header of the access tokens https://datatracker.ietf.org/doc/html/rfc9068#section-2.1
+const accessTokenJWTType = "at+jwt"
+
+// clientCredentialsGrantType marks tokens issued to the client itself in the gty claim
+const clientCredentialsGrantType = "client_credentials"
+
 // Valid claims verification
 func (a *JWTAccessClaims) Valid() error {
 	if time.Unix(a.ExpiresAt, 0).Before(time.Now()) {
@@ -35,6 +43,16 @@ func (a *JWTAccessClaims) Valid() error {
 	return nil
 }
 
+// accessTokenClaims decodes the access token loaded from the token store,
+// the token comes from our own store, so its claims are trusted without verifying the signature
+func accessTokenClaims(ti oauth2.TokenInfo) (*JWTAccessClaims, error) {
+	claims := &JWTAccessClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(ti.GetAccess(), claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
 // NewJWTAccessGenerate create to generate the jwt access token instance
 func NewJWTAccessGenerate(method jwt.SigningMethod, userStore *UserStore) *JWTAccessGenerate {
 	return &JWTAccessGenerate{
@@ -47,6 +65,8 @@ func NewJWTAccessGenerate(method jwt.SigningMethod, userStore *UserStore) *JWTAc
 type JWTAccessGenerate struct {
 	SignedMethod jwt.SigningMethod
 	UserStore    *UserStore
+	// Sessions records the tokens issued in login sessions, see logout.go
+	Sessions *SessionTokenStore
 }
 
 // Token based on the UUID generated token
@@ -60,63 +80,106 @@ func (a *JWTAccessGenerate) Token(data *oauth2.GenerateBasic, isGenRefresh bool)
 	span, ctx := opentracing.StartSpanFromContext(ctx, "oauth - "+spanName)
 	defer span.Finish()
 
-	scope := data.Request.FormValue("scope")
-
-	fmt.Println("feching user", data.UserID)
-	user, fetchErr := a.UserStore.GetUser(ctx, data.UserID)
-	err = fetchErr
-	if err != nil {
-		return
+	// the generator is the only place seeing both the client and the token being issued
+	if cli, ok := data.Client.(*Client); ok {
+		cli.applyTokenLifetimes(data.TokenInfo)
 	}
-
-	standardScopes, nonstandardScopes := separateScopes(scope)
-	if len(nonstandardScopes) > 0 {
-		fmt.Println("validating nonstandard scopes", nonstandardScopes, data.UserID)
-		validatedScopes, err := validateScopeForUser(ctx, strings.Join(nonstandardScopes, " "), data.UserID)
-		if err != nil {
-			return access, refresh, err
-		}
-		nonstandardScopes = strings.Split(validatedScopes, " ")
+	exchange := tokenExchangeFromRequest(data.Request)
+	if exchange != nil && data.TokenInfo.GetAccessCreateAt().Add(data.TokenInfo.GetAccessExpiresIn()).After(exchange.ExpiresAt) {
+		data.TokenInfo.SetAccessExpiresIn(exchange.ExpiresAt.Sub(data.TokenInfo.GetAccessCreateAt()))
 	}
 
-	scope = strings.Join(append(standardScopes, nonstandardScopes...), " ")
-
+	scope := data.TokenInfo.GetScope()
 	claims := &JWTAccessClaims{
 		StandardClaims: jwt.StandardClaims{
+			// jti keeps tokens issued within the same second apart, a refresh would otherwise remove its own token
+			Id:        uuid.Must(uuid.NewRandom()).String(),
 			Audience:  data.Client.GetID(),
 			Subject:   data.UserID,
 			ExpiresAt: data.TokenInfo.GetAccessCreateAt().Add(data.TokenInfo.GetAccessExpiresIn()).Unix(),
 		},
-		Scope: scope,
-		User: JWTUser{
-			Email: user.Email,
-		},
 	}
 
+	if data.UserID == "" {
+		// machine to machine token, the scopes are limited by the client instead of the user
+		if cli, ok := data.Client.(*Client); ok && !cli.AllowsScope(scope) {
+			err = errors.ErrInvalidScope
+			return
+		}
+		claims.Subject = data.Client.GetID()
+		claims.GrantType = clientCredentialsGrantType
+		if exchange != nil {
+			claims.Subject = exchange.Subject
+		}
+	} else {
+		user, fetchErr := a.UserStore.GetUser(ctx, data.UserID)
+		err = fetchErr
+		if err != nil {
+			return
+		}
+		if user == nil {
+			err = errors.ErrInvalidGrant
+			return
+		}
+		claims.User = &JWTUser{Email: user.Email}
+
+		standardScopes, nonstandardScopes := separateScopes(scope)
+		if len(nonstandardScopes) > 0 {
+			validatedScopes, err := validateScopeForUser(ctx, strings.Join(nonstandardScopes, " "), data.UserID)
+			if err != nil {
+				return access, refresh, err
+			}
+			nonstandardScopes = strings.Split(validatedScopes, " ")
+		}
+		scope = strings.Join(append(standardScopes, nonstandardScopes...), " ")
+	}
+	if containsScope(scope, getAdminScope()) && !adminScopeAllowed(data.Client, data.UserID) {
+		err = errors.ErrInvalidScope
+		return
+	}
+	claims.Scope = scope
+	// tokens requested over mutual TLS can only be used with the same certificate
+	if cert := clientCertificate(data.Request); cert != nil {
+		claims.Confirmation = &ConfirmationClaim{X5TS256: certificateThumbprint(cert)}
+	}
+	// and tokens requested with DPoP proof only with proofs of the same key
+	if jkt := dpopKeyFromRequest(data.Request); jkt != "" {
+		if claims.Confirmation == nil {
+			claims.Confirmation = &ConfirmationClaim{}
+		}
+		claims.Confirmation.JKT = jkt
+	}
+	if exchange != nil {
+		claims.Actor = exchange.Actor
+		if exchange.Audience != "" {
+			claims.Audience = exchange.Audience
+		}
+	}
+
+	// the access tokens are verified with the published JWKS like the ID tokens, the typ tells them apart
 	token := jwt.NewWithClaims(a.SignedMethod, claims)
-	signedKey, kid, err := getRSAKey()
+	token.Header["typ"] = accessTokenJWTType
+	access, err = signToken(token)
 	if err != nil {
 		return
 	}
 
-	token.Header["kid"] = kid
-
-	var key interface{}
-	if a.isEs() {
-		key, err = jwt.ParseECPrivateKeyFromPEM(signedKey.D.Bytes())
-		if err != nil {
-			return "", "", err
+	// logout revokes the tokens issued in the login session, refreshed tokens are found by their family
+	if auth := authenticationFromRequest(data.Request); auth != nil && auth.SessionID != "" && a.Sessions != nil {
+		st := &SessionToken{
+			AccessHash: hashToken(access),
+			SessionID:  auth.SessionID,
+			UserID:     data.UserID,
+			ExpiresAt:  data.TokenInfo.GetAccessCreateAt().Add(data.TokenInfo.GetAccessExpiresIn()),
+		}
+		if err = a.Sessions.Create(st); err != nil {
+			return
 		}
-	} else if a.isRsOrPS() {
-		key = signedKey
-	} else if a.isHs() {
-		key = signedKey
-	} else {
-		return "", "", errs.New("unsupported sign method")
 	}
-	access, err = token.SignedString(key)
-	if err != nil {
-		return
+
+	// the ID token is generated by the ExtensionFieldsHandler, which does not get the request
+	if data.UserID != "" && containsScope(scope, "openid") {
+		rememberAuthentication(data.Request, access)
 	}
 
 	if isGenRefresh {
@@ -127,20 +190,6 @@ func (a *JWTAccessGenerate) Token(data *oauth2.GenerateBasic, isGenRefresh bool)
 	return
 }
 
-func (a *JWTAccessGenerate) isEs() bool {
-	return strings.HasPrefix(a.SignedMethod.Alg(), "ES")
-}
-
-func (a *JWTAccessGenerate) isRsOrPS() bool {
-	isRs := strings.HasPrefix(a.SignedMethod.Alg(), "RS")
-	isPs := strings.HasPrefix(a.SignedMethod.Alg(), "PS")
-	return isRs || isPs
-}
-
-func (a *JWTAccessGenerate) isHs() bool {
-	return strings.HasPrefix(a.SignedMethod.Alg(), "HS")
-}
-
 func containsScope(scopes, s string) bool {
 	_scopes := strings.Split(scopes, " ")
 	for _, _s := range _scopes {
@@ -151,6 +200,19 @@ func containsScope(scopes, s string) bool {
 	return false
 }
 
+// standardScopes are the OpenID Connect scopes handled by this server,
+// every other scope is validated by the scope validator
+var standardScopes = []string{"openid", "profile", "email", "phone", "address"}
+
+func isStandardScope(scope string) bool {
+	for _, s := range standardScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
 func separateScopes(scopes string) (standard, nonstandard []string) {
 	standard = []string{}
 	nonstandard = []string{}
@@ -158,7 +220,7 @@ func separateScopes(scopes string) (standard, nonstandard []string) {
 		return
 	}
 	for _, scope := range strings.Split(scopes, " ") {
-		if scope == "openid" || scope == "profile" || scope == "email" {
+		if isStandardScope(scope) {
 			standard = append(standard, scope)
 		} else {
 			nonstandard = append(nonstandard, scope)
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestJWTAccessGenerateClientCredentials(t *testing.T) {
+	defer useTestSigningKey(t)()
+
+	restricted := &Client{ID: "svc", Scopes: database.StringList{"orders:read"}}
+	cases := []struct {
+		name   string
+		client *Client
+		scope  string
+		err    error
+	}{
+		{"allowed scope", restricted, "orders:read", nil},
+		{"scope outside client scopes", restricted, "orders:write", errors.ErrInvalidScope},
+		{"unrestricted client", &Client{ID: "any"}, "orders:write", nil},
+		{"admin scope of unrestricted client", &Client{ID: "any"}, "admin", errors.ErrInvalidScope},
+	}
+	for _, c := range cases {
+		ti := models.NewToken()
+		ti.SetScope(c.scope)
+		ti.SetAccessCreateAt(time.Now())
+		ti.SetAccessExpiresIn(time.Hour)
+		data := &oauth2.GenerateBasic{
+			Client:    c.client,
+			CreateAt:  time.Now(),
+			TokenInfo: ti,
+			Request:   httptest.NewRequest("POST", "/token", nil),
+		}
+		access, _, err := NewJWTAccessGenerate(jwt.SigningMethodRS256, nil).Token(data, false)
+		if err != c.err {
+			t.Errorf("[%s] expected %v, got %v", c.name, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		ti.SetAccess(access)
+		claims, err := accessTokenClaims(ti)
+		if err != nil {
+			t.Fatalf("[%v] Failed to decode access token", err)
+		}
+		if claims.Subject != c.client.ID || claims.GrantType != clientCredentialsGrantType || claims.User != nil || claims.Scope != c.scope {
+			t.Errorf("[%s] unexpected claims %+v", c.name, claims)
+		}
+		if claims.ExpiresAt != ti.GetAccessCreateAt().Add(time.Hour).Unix() {
+			t.Errorf("[%s] exp should follow the token lifetime, got %d", c.name, claims.ExpiresAt)
+		}
+	}
+}
+
+func TestClientAllowsClientCredentials(t *testing.T) {
+	confidential := &Client{ID: "svc"}
+	if err := confidential.SetSecret("secret"); err != nil {
+		t.Fatalf("[%v] Failed to set secret", err)
+	}
+	if !confidential.AllowsGrantType(oauth2.ClientCredentials) {
+		t.Errorf("confidential client should get client credentials tokens")
+	}
+	if (&Client{ID: "spa"}).AllowsGrantType(oauth2.ClientCredentials) {
+		t.Errorf("public client should not get client credentials tokens")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graphql-services/oauth/database"
+	"github.com/lestrrat/go-jwx/jwk"
+	"github.com/patrickmn/go-cache"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// jwtBearerGrantType https://tools.ietf.org/html/rfc7523#section-2.1
+const jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// TrustedIssuer issuer of assertions accepted by the jwt-bearer grant
+type TrustedIssuer struct {
+	Issuer string `json:"issuer"`
+	// JWKSURI or JWKS with public keys of the issuer
+	JWKSURI string          `json:"jwks_uri,omitempty"`
+	JWKS    json.RawMessage `json:"jwks,omitempty"`
+	// Subjects the issuer may assert, empty allows any subject
+	Subjects []string `json:"subjects,omitempty"`
+	// Scopes the issuer may grant, empty allows any scope the client is allowed
+	Scopes []string `json:"scopes,omitempty"`
+	// AccountType of the user accounts the subjects are looked up in, the issuer by default
+	AccountType string `json:"account_type,omitempty"`
+}
+
+func (i *TrustedIssuer) allowsSubject(subject string) bool {
+	if len(i.Subjects) == 0 {
+		return true
+	}
+	for _, s := range i.Subjects {
+		if s == subject {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *TrustedIssuer) allowsScope(scope string) bool {
+	if len(i.Scopes) == 0 {
+		return true
+	}
+	for _, s := range strings.Fields(scope) {
+		if !containsScope(strings.Join(i.Scopes, " "), s) {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *TrustedIssuer) accountType() string {
+	if i.AccountType != "" {
+		return i.AccountType
+	}
+	return i.Issuer
+}
+
+// loadTrustedIssuers reads the trusted issuers file, the grant accepts no assertions without it
+func loadTrustedIssuers() (issuers map[string]*TrustedIssuer, err error) {
+	issuers = map[string]*TrustedIssuer{}
+	filename := os.Getenv("TRUSTED_ISSUERS_FILE")
+	if filename == "" {
+		filename = "trusted_issuers.json"
+	}
+	if _, statErr := os.Stat(filename); os.IsNotExist(statErr) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	var list []*TrustedIssuer
+	if err = json.Unmarshal(data, &list); err != nil {
+		return
+	}
+	for _, i := range list {
+		if i.Issuer == "" || (i.JWKSURI == "") == (len(i.JWKS) == 0) {
+			err = fmt.Errorf("trusted issuer %q needs issuer and either jwks_uri or jwks", i.Issuer)
+			return
+		}
+		if len(i.JWKS) > 0 {
+			if _, err = jwk.Parse(i.JWKS); err != nil {
+				return
+			}
+		}
+		issuers[i.Issuer] = i
+		log.Printf("Trusting assertions of %s", i.Issuer)
+	}
+	return
+}
+
+// remoteJWKS caches key sets fetched from jwks_uri
+var remoteJWKS = cache.New(10*time.Minute, 10*time.Minute)
+
+func fetchJWKS(uri string) (*jwk.Set, error) {
+	if v, ok := remoteJWKS.Get(uri); ok {
+		return v.(*jwk.Set), nil
+	}
+	set, err := jwk.Fetch(uri)
+	if err != nil {
+		return nil, err
+	}
+	remoteJWKS.Set(uri, set, cache.DefaultExpiration)
+	return set, nil
+}
+
+// assertionKeyFunc selects the verification key by kid, key sets with single key may leave kid out.
+// Only asymmetric algorithms are accepted, the keys are public.
+func assertionKeyFunc(set *jwk.Set) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		keys := set.Keys
+		if kid, _ := t.Header["kid"].(string); kid != "" {
+			keys = set.LookupKeyID(kid)
+		}
+		if len(keys) != 1 {
+			return nil, fmt.Errorf("no unique key for the assertion")
+		}
+		return keys[0].Materialize()
+	}
+}
+
+// assertionAudienceMatches accepts aud as string or array, it has to contain one of the expected values
+func assertionAudienceMatches(aud interface{}, expected ...string) bool {
+	values := []interface{}{aud}
+	if list, ok := aud.([]interface{}); ok {
+		values = list
+	}
+	for _, v := range values {
+		for _, e := range expected {
+			if s, ok := v.(string); ok && s == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UsedAssertion jti of accepted assertion, kept until the assertion expires to refuse its replay
+type UsedAssertion struct {
+	Issuer    string `gorm:"primary_key"`
+	JTI       string `gorm:"primary_key"`
+	ExpiresAt time.Time
+}
+
+type AssertionStore struct {
+	DB *database.DB
+}
+
+func (s *AssertionStore) AutoMigrate() error {
+	return s.DB.AutoMigrate(&UsedAssertion{})
+}
+
+// Use records the jti, it returns false when the assertion was already used.
+// The insert itself detects the replay so concurrent requests can not both use it
+func (s *AssertionStore) Use(issuer, jti string, expiresAt time.Time) (bool, error) {
+	if err := s.DB.Client().Where("expires_at < ?", time.Now()).Delete(&UsedAssertion{}).Error; err != nil {
+		return false, err
+	}
+	err := s.DB.Client().Create(&UsedAssertion{Issuer: issuer, JTI: jti, ExpiresAt: expiresAt}).Error
+	if database.IsUniqueViolation(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// maxAssertionLifetime limits how far in the future the assertion may expire, it bounds the replay table
+func maxAssertionLifetime() time.Duration {
+	return time.Second * time.Duration(getEnvInt("JWT_BEARER_MAX_ASSERTION_LIFETIME", 3600))
+}
+
+// JWTBearerGrant dependencies of the jwt-bearer grant
+type JWTBearerGrant struct {
+	Issuers    map[string]*TrustedIssuer
+	Assertions *AssertionStore
+	Users      *UserStore
+}
+
+// jwtBearerToken issues token of the user the assertion subject is mapped to
+// https://tools.ietf.org/html/rfc7523#section-3
+func jwtBearerToken(r *http.Request, srv *server.Server, grant *JWTBearerGrant) (oauth2.TokenInfo, error) {
+	cli, err := authenticateClient(r, srv.Manager)
+	if err != nil {
+		return nil, err
+	}
+	if !cli.AllowsGrantType(oauth2.GrantType(jwtBearerGrantType)) {
+		return nil, errors.ErrUnauthorizedClient
+	}
+	assertion := r.PostFormValue("assertion")
+	if assertion == "" {
+		return nil, errors.ErrInvalidRequest
+	}
+
+	issuer, claims, err := verifyAssertion(r, grant, assertion)
+	if err != nil {
+		log.Println("Invalid assertion:", err)
+		return nil, errors.ErrInvalidGrant
+	}
+
+	scope := r.PostFormValue("scope")
+	if !issuer.allowsScope(scope) || !cli.AllowsScope(scope) {
+		return nil, errors.ErrInvalidScope
+	}
+
+	subject, _ := claims["sub"].(string)
+	user, err := grant.Users.GetUserByAccount(r.Context(), subject, issuer.accountType())
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.ErrInvalidGrant
+	}
+
+	// the client can assert again, so the client credentials config without refresh token is used
+	return srv.Manager.GenerateAccessToken(oauth2.ClientCredentials, &oauth2.TokenGenerateRequest{
+		ClientID:     cli.GetID(),
+		ClientSecret: cli.GetSecret(),
+		UserID:       user.ID,
+		Scope:        scope,
+		Request:      r,
+	})
+}
+
+// verifyAssertion checks the signature of trusted issuer, the claims and that the jti was not used before
+// https://tools.ietf.org/html/rfc7523#section-3
+func verifyAssertion(r *http.Request, grant *JWTBearerGrant, assertion string) (*TrustedIssuer, jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(assertion, claims); err != nil {
+		return nil, nil, err
+	}
+	iss, _ := claims["iss"].(string)
+	issuer, ok := grant.Issuers[iss]
+	if !ok {
+		return nil, nil, fmt.Errorf("untrusted issuer %q", iss)
+	}
+
+	var set *jwk.Set
+	var err error
+	if issuer.JWKSURI != "" {
+		set, err = fetchJWKS(issuer.JWKSURI)
+	} else {
+		set, err = jwk.Parse(issuer.JWKS)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// Parse checks exp, nbf and iat when they are present
+	if _, err := new(jwt.Parser).ParseWithClaims(assertion, claims, assertionKeyFunc(set)); err != nil {
+		return nil, nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" || !issuer.allowsSubject(subject) {
+		return nil, nil, fmt.Errorf("subject %q not allowed for %s", subject, iss)
+	}
+	issuerURL := getIssuer()
+	if issuerURL == "" {
+		return nil, nil, fmt.Errorf("ISSUER_URL is not configured")
+	}
+	if !assertionAudienceMatches(claims["aud"], issuerURL, issuerURL+"/token") {
+		return nil, nil, fmt.Errorf("assertion is not for this server")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, nil, fmt.Errorf("assertion has no exp")
+	}
+	expiresAt := time.Unix(int64(exp), 0)
+	if time.Until(expiresAt) > maxAssertionLifetime() {
+		return nil, nil, fmt.Errorf("assertion expires too late")
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, nil, fmt.Errorf("assertion has no jti")
+	}
+	fresh, err := grant.Assertions.Use(iss, jti, expiresAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fresh {
+		securityEvent(r.Context(), "assertion_replay", map[string]string{"issuer": iss, "jti": jti, "sub": subject})
+		return nil, nil, fmt.Errorf("assertion %s was already used", jti)
+	}
+	return issuer, claims, nil
+}
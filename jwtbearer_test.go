@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/graphql-services/oauth/database"
+)
+
+func TestAssertionStoreUse(t *testing.T) {
+	assertions := AssertionStore{DB: database.NewDBWithString("sqlite3://:memory:")}
+	if err := assertions.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	if err := assertions.DB.Client().Create(&UsedAssertion{Issuer: "client:app", JTI: "expired", ExpiresAt: time.Now().Add(-time.Minute)}).Error; err != nil {
+		t.Fatalf("[%v] Failed to create used assertion", err)
+	}
+
+	cases := []struct {
+		name   string
+		issuer string
+		jti    string
+		ok     bool
+	}{
+		{"first use", "client:app", "a1", true},
+		{"replay", "client:app", "a1", false},
+		{"other issuer", "dpop:key", "a1", true},
+		{"expired jti", "client:app", "expired", true},
+	}
+	for _, c := range cases {
+		ok, err := assertions.Use(c.issuer, c.jti, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("[%v] Failed to record assertion", err)
+		}
+		if ok != c.ok {
+			t.Errorf("[%s] expected %v, got %v", c.name, c.ok, ok)
+		}
+	}
+}
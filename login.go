@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-session/session"
+	opentracing "github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+// pageHead is shared by the html pages, the binary is deployed alone, so the pages are kept in the source
+const pageHead = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{.Title}}</title>
+	<style>
+		body { font-family: sans-serif; max-width: 360px; margin: 80px auto; padding: 0 16px; }
+		label, input, button { display: block; width: 100%; box-sizing: border-box; }
+		input { margin: 4px 0 16px; padding: 8px; }
+		button { padding: 8px; margin-bottom: 8px; }
+		.error { color: #b00020; }
+	</style>
+</head>
+<body>
+`
+
+var loginTemplate = template.Must(template.New("login").Parse(pageHead + `
+	<h1>Sign in</h1>
+	{{if .LoggedIn}}
+	<p>You are signed in.</p>
+	{{else}}
+	{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+	<form method="post" action="/login">
+		<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+		<label for="email">Email</label>
+		<input id="email" type="email" name="email" value="{{.Email}}" autocomplete="username" required autofocus>
+		<label for="password">Password</label>
+		<input id="password" type="password" name="password" autocomplete="current-password" required>
+		<button type="submit">Sign in</button>
+	</form>
+	{{end}}
+</body>
+</html>
+`))
+
+type loginPage struct {
+	Title     string
+	CSRFToken string
+	Email     string
+	Error     string
+	LoggedIn  bool
+}
+
+// loginHandler renders the login form and signs the user in with the IDP credentials,
+// the authorization request saved by userAuthorizeHandler is resumed afterwards
+func loginHandler(idp *IDPClient, users *UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store, err := session.Start(nil, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			// login_hint of the authorization request prefills the email
+			page := loginPage{}
+			returnURI, _ := store.Get("ReturnUri")
+			if form, ok := returnURI.(url.Values); ok {
+				page.Email = form.Get("login_hint")
+			}
+			renderLoginPage(w, store, http.StatusOK, page)
+		case http.MethodPost:
+			login(w, r, store, idp, users)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func login(w http.ResponseWriter, r *http.Request, store session.Store, idp *IDPClient, users *UserStore) {
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	password := r.PostFormValue("password")
+
+	if !validCSRFToken(store, r) {
+		renderLoginPage(w, store, http.StatusForbidden, loginPage{Email: email, Error: "The form has expired, please try again."})
+		return
+	}
+	if email == "" || password == "" {
+		renderLoginPage(w, store, http.StatusBadRequest, loginPage{Email: email, Error: "Email and password are required."})
+		return
+	}
+
+	span, ctx := opentracing.StartSpanFromContext(r.Context(), "oauth - /login")
+	defer span.Finish()
+	span.LogFields(otlog.String("email", email))
+
+	idpUser, err := idp.FetchIDPUser(ctx, email, password)
+	if err != nil || idpUser.ID == "" {
+		log.Println("Login failed:", email, err)
+		renderLoginPage(w, store, http.StatusUnauthorized, loginPage{Email: email, Error: "Invalid email or password."})
+		return
+	}
+	user, err := users.GetOrCreateUserWithAccount(ctx, idpUser.ID, email, "idp")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// new session id prevents session fixation
+	store, err = session.Refresh(nil, w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	store.Delete("CSRFToken")
+	store.Set("LoggedInUserID", user.ID)
+	store.Set("AuthTime", time.Now().Unix())
+	if request, ok := store.Get("LoginRequest"); ok {
+		store.Set("SignedInRequest", request)
+		store.Delete("LoginRequest")
+	}
+	returnURI, _ := store.Get("ReturnUri")
+	returnPath, _ := store.Get("ReturnPath")
+	store.Delete("ReturnUri")
+	store.Delete("ReturnPath")
+	if err := store.Save(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	form, ok := returnURI.(url.Values)
+	if !ok {
+		renderLoginPage(w, store, http.StatusOK, loginPage{LoggedIn: true})
+		return
+	}
+	// ReturnPath is set by pages other than /authorize which need the user to sign in
+	path, ok := returnPath.(string)
+	if !ok {
+		path = "/authorize"
+	}
+	w.Header().Set("Location", path+"?"+authorizeReturnQuery(form))
+	w.WriteHeader(http.StatusFound)
+}
+
+// renderLoginPage renders the form with CSRF token kept in the session
+func renderLoginPage(w http.ResponseWriter, store session.Store, statusCode int, page loginPage) {
+	page.Title = "Sign in"
+	if !page.LoggedIn {
+		var err error
+		if page.CSRFToken, err = csrfToken(store); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	renderPage(w, loginTemplate, statusCode, page)
+}
+
+func renderPage(w http.ResponseWriter, t *template.Template, statusCode int, page interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(statusCode)
+	if err := t.Execute(w, page); err != nil {
+		log.Println("Page error:", err)
+	}
+}
+
+// csrfToken returns the CSRF token of the session, the token is created when missing
+func csrfToken(store session.Store) (token string, err error) {
+	v, _ := store.Get("CSRFToken")
+	token, _ = v.(string)
+	if token != "" {
+		return
+	}
+	if token, err = generateSecret(); err != nil {
+		return
+	}
+	store.Set("CSRFToken", token)
+	err = store.Save()
+	return
+}
+
+// validCSRFToken compares the posted csrf_token with the session one
+func validCSRFToken(store session.Store, r *http.Request) bool {
+	v, _ := store.Get("CSRFToken")
+	token, _ := v.(string)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.PostFormValue("csrf_token"))) == 1
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-session/session"
+	"github.com/graphql-services/oauth/database"
+)
+
+// newTestIDPServer fakes the IDP login query, password is the only valid password
+func newTestIDPServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Variables map[string]string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Variables["password"] != "password" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []map[string]string{{"message": "invalid credentials"}}})
+			return
+		}
+		user := IDPUser{ID: "idp-" + req.Variables["email"], Email: req.Variables["email"]}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": IDPUserResponse{Result: user}})
+	}))
+}
+
+var csrfTokenPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// testSessionCookie returns the session cookie set by the response
+func testSessionCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "go_session_id" {
+			return c
+		}
+	}
+	t.Fatalf("session cookie should be set")
+	return nil
+}
+
+func TestLoginHandler(t *testing.T) {
+	idp := newTestIDPServer()
+	defer idp.Close()
+	id := newTestIDServer()
+	defer id.Close()
+	users := UserStore{DB: database.NewDBWithString("sqlite3://:memory:"), ID: &IDClient{URL: id.URL}}
+	if err := users.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	handler := loginHandler(&IDPClient{URL: idp.URL}, &users)
+
+	// the authorization request waiting for the user to sign in
+	w := httptest.NewRecorder()
+	store, err := session.Start(nil, w, httptest.NewRequest("GET", "/authorize", nil))
+	if err != nil {
+		t.Fatalf("[%v] Failed to start session", err)
+	}
+	store.Set("ReturnUri", url.Values{"client_id": {"app"}, "login_hint": {"john.doe@example.com"}})
+	if err := store.Save(); err != nil {
+		t.Fatalf("[%v] Failed to save session", err)
+	}
+	cookie := testSessionCookie(t, w)
+
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, `value="john.doe@example.com"`) {
+		t.Fatalf("login page should be prefilled with login_hint, got %d", w.Code)
+	}
+	match := csrfTokenPattern.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("login page should contain the CSRF token")
+	}
+
+	cases := []struct {
+		name       string
+		csrfToken  string
+		password   string
+		statusCode int
+	}{
+		{"missing csrf token", "", "password", http.StatusForbidden},
+		{"wrong password", match[1], "wrong", http.StatusUnauthorized},
+		{"sign in", match[1], "password", http.StatusFound},
+	}
+	for _, c := range cases {
+		form := url.Values{"csrf_token": {c.csrfToken}, "email": {"john.doe@example.com"}, "password": {c.password}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.statusCode {
+			t.Errorf("[%s] expected %d, got %d", c.name, c.statusCode, w.Code)
+			continue
+		}
+		if w.Code != http.StatusFound {
+			continue
+		}
+		if location := w.Header().Get("Location"); !strings.HasPrefix(location, "/authorize?") || !strings.Contains(location, "client_id=app") {
+			t.Errorf("[%s] should resume the authorization request, got %s", c.name, location)
+		}
+		if refreshed := testSessionCookie(t, w); refreshed.Value == cookie.Value {
+			t.Errorf("[%s] session id should change on sign in", c.name)
+		}
+	}
+}
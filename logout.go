@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/go-session/session"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+var logoutTemplate = template.Must(template.New("logout").Parse(pageHead + `
+	<h1>Sign out</h1>
+	{{if .LoggedOut}}
+	<p>You are signed out.</p>
+	{{else}}
+	<p>Do you want to sign out{{if .ClientName}} of {{.ClientName}}{{end}}?</p>
+	<form method="post" action="/logout">
+		<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+		{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+		{{end}}
+		<button type="submit">Sign out</button>
+	</form>
+	{{end}}
+</body>
+</html>
+`))
+
+type logoutPage struct {
+	Title      string
+	CSRFToken  string
+	ClientName string
+	Params     map[string]string
+	LoggedOut  bool
+}
+
+// SessionToken access token issued in the login session, logout revokes it with LOGOUT_REVOKE_TOKENS.
+// Only the hash of the token is kept, the token itself is found in the token store by its user.
+type SessionToken struct {
+	AccessHash string `gorm:"primary_key"`
+	SessionID  string `gorm:"index"`
+	UserID     string
+	ExpiresAt  time.Time `gorm:"index"`
+	CreatedAt  time.Time
+}
+
+type SessionTokenStore struct {
+	DB *database.DB
+}
+
+func (s *SessionTokenStore) AutoMigrate() error {
+	return s.DB.AutoMigrate(&SessionToken{})
+}
+
+func (s *SessionTokenStore) Create(t *SessionToken) error {
+	// tokens which expired can not be revoked anymore, so they are dropped here instead of a separate gc
+	if err := s.DB.Client().Where("expires_at < ?", time.Now()).Delete(&SessionToken{}).Error; err != nil {
+		return err
+	}
+	return s.DB.Client().Create(t).Error
+}
+
+// Revoke removes the tokens issued in the session from the token table, tokens which are already gone are skipped
+func (s *SessionTokenStore) Revoke(sessionID string) error {
+	if sessionID == "" {
+		// the zero value would match every token
+		return nil
+	}
+	var tokens []SessionToken
+	if err := s.DB.Client().Where(&SessionToken{SessionID: sessionID}).Find(&tokens).Error; err != nil {
+		return err
+	}
+	hashes := map[string]bool{}
+	users := map[string]bool{}
+	for _, t := range tokens {
+		hashes[t.AccessHash] = true
+		users[t.UserID] = true
+	}
+	for userID := range users {
+		err := removeStoredTokens(s.DB, `%"UserID":"`+userID+`"%`, func(t models.Token) bool {
+			return t.UserID == userID && hashes[hashToken(t.Access)]
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.DB.Client().Where(&SessionToken{SessionID: sessionID}).Delete(&SessionToken{}).Error
+}
+
+// LogoutRequest parameters of the RP-initiated logout
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html#RPLogout
+type LogoutRequest struct {
+	IDTokenHint           string
+	ClientID              string
+	PostLogoutRedirectURI string
+	State                 string
+	client                *Client
+}
+
+// logoutHandler asks the signed in user to confirm the logout, destroys the session and returns the user to the client.
+// With LOGOUT_REVOKE_TOKENS=true the tokens issued in the session and the refresh token families granted in it are revoked as well.
+func logoutHandler(clients *ClientStore, refreshTokens *RefreshTokenStore, sessions *SessionTokenStore, tokenStore oauth2.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		req, err := parseLogoutRequest(r, clients)
+		if err != nil {
+			log.Println("Invalid logout request:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		store, err := session.Start(nil, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, ok := store.Get("LoggedInUserID"); !ok {
+			finishLogout(w, req)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			// the confirmation keeps other sites from signing the user out with a link
+			page := logoutPage{Title: "Sign out", Params: req.params()}
+			if req.client != nil {
+				page.ClientName = req.client.ID
+				if name, ok := req.client.Metadata["client_name"].(string); ok && name != "" {
+					page.ClientName = name
+				}
+			}
+			if page.CSRFToken, err = csrfToken(store); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			renderPage(w, logoutTemplate, http.StatusOK, page)
+			return
+		}
+
+		if !validCSRFToken(store, r) {
+			http.Error(w, "The form has expired, please try again", http.StatusForbidden)
+			return
+		}
+		if os.Getenv("LOGOUT_REVOKE_TOKENS") == "true" {
+			sessionID := sessionIDHash(store)
+			if err := sessions.Revoke(sessionID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := refreshTokens.RevokeSession(sessionID, tokenStore); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := session.Destroy(nil, w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		finishLogout(w, req)
+	}
+}
+
+// parseLogoutRequest finds the client by client_id or audience of id_token_hint
+// and checks post_logout_redirect_uri is registered for it
+func parseLogoutRequest(r *http.Request, clients *ClientStore) (*LogoutRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	req := &LogoutRequest{
+		IDTokenHint:           r.FormValue("id_token_hint"),
+		ClientID:              r.FormValue("client_id"),
+		PostLogoutRedirectURI: r.FormValue("post_logout_redirect_uri"),
+		State:                 r.FormValue("state"),
+	}
+
+	clientID := req.ClientID
+	if req.IDTokenHint != "" {
+		claims, err := parseIDTokenHint(req.IDTokenHint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id_token_hint: %s", err)
+		}
+		if clientID != "" && claims.Audience != clientID {
+			return nil, fmt.Errorf("the id_token_hint was not issued to the client")
+		}
+		clientID = claims.Audience
+	}
+	if clientID != "" {
+		client, err := clients.Get(clientID)
+		if err != nil {
+			return nil, err
+		}
+		if client == nil {
+			return nil, fmt.Errorf("unknown client")
+		}
+		req.client = client
+	}
+
+	if req.PostLogoutRedirectURI != "" {
+		if req.client == nil || !req.client.PostLogoutRedirectURIs.Contains(req.PostLogoutRedirectURI) {
+			return nil, fmt.Errorf("the post_logout_redirect_uri is not registered for the client")
+		}
+	}
+	return req, nil
+}
+
+// params are posted again by the confirmation form
+func (req *LogoutRequest) params() map[string]string {
+	params := map[string]string{}
+	for name, value := range map[string]string{
+		"id_token_hint":            req.IDTokenHint,
+		"client_id":                req.ClientID,
+		"post_logout_redirect_uri": req.PostLogoutRedirectURI,
+		"state":                    req.State,
+	} {
+		if value != "" {
+			params[name] = value
+		}
+	}
+	return params
+}
+
+// finishLogout returns the user to the client with the state or shows the user is signed out
+func finishLogout(w http.ResponseWriter, req *LogoutRequest) {
+	if req.PostLogoutRedirectURI == "" {
+		renderPage(w, logoutTemplate, http.StatusOK, logoutPage{Title: "Sign out", LoggedOut: true})
+		return
+	}
+	u, err := url.Parse(req.PostLogoutRedirectURI)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.State != "" {
+		q := u.Query()
+		q.Set("state", req.State)
+		u.RawQuery = q.Encode()
+	}
+	w.Header().Set("Location", u.String())
+	w.WriteHeader(http.StatusFound)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graphql-services/oauth/database"
+	oauth2gorm "github.com/techknowlogick/go-oauth2-gorm"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestSessionTokenStoreRevoke(t *testing.T) {
+	db := database.NewDBWithString("sqlite3://:memory:")
+	s := SessionTokenStore{DB: db}
+	if err := s.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	tokens := oauth2gorm.NewStoreWithDB(&oauth2gorm.Config{TableName: tokenTableName}, db.Client(), 1800)
+
+	issued := map[string]string{"implicit": "s1", "code": "s1", "other": "s2"}
+	for access, sessionID := range issued {
+		if err := tokens.Create(&models.Token{ClientID: "app", UserID: "u1", Access: access, AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour}); err != nil {
+			t.Fatalf("[%v] Failed to store token", err)
+		}
+		if err := s.Create(&SessionToken{AccessHash: hashToken(access), SessionID: sessionID, UserID: "u1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("[%v] Failed to record session token", err)
+		}
+	}
+	// the token was revoked before the logout
+	if err := s.Create(&SessionToken{AccessHash: hashToken("revoked"), SessionID: "s1", UserID: "u1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("[%v] Failed to record session token", err)
+	}
+	var stored SessionToken
+	if err := db.Client().First(&stored, &SessionToken{AccessHash: hashToken("code")}).Error; err != nil || stored.AccessHash == "code" {
+		t.Fatalf("[%v] only the hash of the token should be recorded", err)
+	}
+
+	if err := s.Revoke("s1"); err != nil {
+		t.Fatalf("[%v] Failed to revoke session tokens", err)
+	}
+	for access, sessionID := range issued {
+		ti, err := tokens.GetByAccess(access)
+		if err != nil {
+			t.Fatalf("[%v] Failed to get token", err)
+		}
+		if revoked := ti == nil; revoked != (sessionID == "s1") {
+			t.Errorf("[%s] of session %s revoked: %v", access, sessionID, revoked)
+		}
+	}
+	if err := s.Revoke(""); err != nil {
+		t.Errorf("[%v] empty session should be ignored", err)
+	}
+	if ti, _ := tokens.GetByAccess("other"); ti == nil {
+		t.Errorf("empty session should not revoke other tokens")
+	}
+}
+
+func TestParseLogoutRequest(t *testing.T) {
+	os.Setenv("ISSUER_URL", "https://auth.example.com")
+	defer os.Unsetenv("ISSUER_URL")
+	defer useTestSigningKey(t)()
+
+	clients := ClientStore{DB: database.NewDBWithString("sqlite3://:memory:")}
+	if err := clients.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	if err := clients.Create(&Client{ID: "app", PostLogoutRedirectURIs: database.StringList{"https://app.example.com/bye"}}); err != nil {
+		t.Fatalf("[%v] Failed to create client", err)
+	}
+	idToken := signTestIDTokenHint(t, "", &IDTokenClaims{Issuer: "https://auth.example.com", Audience: "app", Subject: "u1"})
+	accessToken := signTestIDTokenHint(t, accessTokenJWTType, &JWTAccessClaims{StandardClaims: jwt.StandardClaims{Issuer: "https://auth.example.com", Audience: "app", Subject: "u1"}})
+
+	cases := []struct {
+		name  string
+		form  url.Values
+		valid bool
+	}{
+		{"id_token_hint", url.Values{"id_token_hint": {idToken}, "post_logout_redirect_uri": {"https://app.example.com/bye"}}, true},
+		{"access token as id_token_hint", url.Values{"id_token_hint": {accessToken}, "post_logout_redirect_uri": {"https://app.example.com/bye"}}, false},
+		{"unregistered post_logout_redirect_uri", url.Values{"id_token_hint": {idToken}, "post_logout_redirect_uri": {"https://evil.example.com"}}, false},
+		{"post_logout_redirect_uri without client", url.Values{"post_logout_redirect_uri": {"https://app.example.com/bye"}}, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/logout?"+c.form.Encode(), nil)
+		if _, err := parseLogoutRequest(r, &clients); (err == nil) != c.valid {
+			t.Errorf("[%s] expected valid %v, got %v", c.name, c.valid, err)
+		}
+	}
+}
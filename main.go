@@ -12,17 +12,14 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-session/session"
-	"github.com/google/uuid"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/rs/cors"
 	oauth2gorm "github.com/techknowlogick/go-oauth2-gorm"
-	"gopkg.in/oauth2.v3"
-	"gopkg.in/oauth2.v3/models"
-	"gopkg.in/oauth2.v3/store"
 
 	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/generates"
 	"gopkg.in/oauth2.v3/manage"
 	"gopkg.in/oauth2.v3/server"
 
@@ -37,6 +34,9 @@ func main() {
 	if databaseURL == "" {
 		panic(fmt.Errorf("Missing DATABASE_URL environment variable"))
 	}
+	if getIssuer() == "" {
+		panic(fmt.Errorf("Missing ISSUER_URL environment variable"))
+	}
 
 	db := database.NewDBWithString(databaseURL)
 
@@ -46,39 +46,83 @@ func main() {
 	if err := userStore.AutoMigrate(); err != nil {
 		panic(err)
 	}
+	codeStore := AuthorizationCodeStore{DB: db}
+	if err := codeStore.AutoMigrate(); err != nil {
+		panic(err)
+	}
+	clientStore := ClientStore{DB: db}
+	if err := clientStore.AutoMigrate(); err != nil {
+		panic(err)
+	}
+	if err := clientStore.Seed(); err != nil {
+		panic(err)
+	}
+	consentStore := ConsentStore{DB: db}
+	if err := consentStore.AutoMigrate(); err != nil {
+		panic(err)
+	}
+	refreshTokenStore := RefreshTokenStore{DB: db}
+	if err := refreshTokenStore.AutoMigrate(); err != nil {
+		panic(err)
+	}
+	deviceCodeStore := DeviceCodeStore{DB: db}
+	if err := deviceCodeStore.AutoMigrate(); err != nil {
+		panic(err)
+	}
+	assertionStore := AssertionStore{DB: db}
+	if err := assertionStore.AutoMigrate(); err != nil {
+		panic(err)
+	}
+	clientAssertions = &assertionStore
+	trustedIssuers, err := loadTrustedIssuers()
+	if err != nil {
+		panic(err)
+	}
+	if clientCAs, err = loadClientCAs(); err != nil {
+		panic(err)
+	}
+	parStore := PushedAuthorizationRequestStore{DB: db}
+	if err := parStore.AutoMigrate(); err != nil {
+		panic(err)
+	}
+	sessionTokenStore := SessionTokenStore{DB: db}
+	if err := sessionTokenStore.AutoMigrate(); err != nil {
+		panic(err)
+	}
+	initialAccessTokenStore := InitialAccessTokenStore{DB: db}
+	if err := initialAccessTokenStore.AutoMigrate(); err != nil {
+		panic(err)
+	}
 
 	t := Tracer{}
 	t.Initialize()
 	defer t.Close()
 
 	manager := manage.NewDefaultManager()
-	manager.SetAuthorizeCodeTokenCfg(manage.DefaultAuthorizeCodeTokenCfg)
+	manager.SetAuthorizeCodeTokenCfg(&manage.Config{AccessTokenExp: manage.DefaultAuthorizeCodeTokenCfg.AccessTokenExp, RefreshTokenExp: refreshTokenIdleLifetime(), IsGenerateRefresh: true})
+	manager.MapAuthorizeGenerate(&AuthorizeGenerate{AuthorizeGenerate: generates.NewAuthorizeGenerate(), Codes: &codeStore})
+	manager.SetValidateURIHandler(validateRedirectURI)
 
 	// token memory store
-	dbStore := oauth2gorm.NewStoreWithDB(&oauth2gorm.Config{}, db.Client(), 1800)
+	dbStore := oauth2gorm.NewStoreWithDB(&oauth2gorm.Config{TableName: tokenTableName}, db.Client(), 1800)
 
 	// manager.MustTokenStorage(store.NewMemoryTokenStore())
 	manager.MapTokenStorage(dbStore)
 
-	// client memory store
-	clientStore := store.NewClientStore()
-
-	clientStore.Set("default", &models.Client{
-		Domain: "example.com",
-		ID:     "default",
-		Secret: "default",
-	})
-
-	manager.MapClientStorage(clientStore)
+	manager.MapClientStorage(&clientStore)
 
 	srv := server.NewDefaultServer(manager)
 	srv.SetAllowGetAccessRequest(true)
-	srv.SetClientInfoHandler(server.ClientFormHandler)
+	srv.SetClientAuthorizedHandler(clientStore.ClientAuthorizedHandler)
+	srv.SetClientScopeHandler(clientStore.ClientScopeHandler)
 
-	manager.SetPasswordTokenCfg(&manage.Config{AccessTokenExp: time.Second * time.Duration(getEnvInt("ACCESS_TOKEN_EXPIRE_IN", 7200)), RefreshTokenExp: time.Hour * 24 * 7, IsGenerateRefresh: true})
-	manager.SetRefreshTokenCfg(manage.DefaultRefreshTokenCfg)
+	manager.SetPasswordTokenCfg(&manage.Config{AccessTokenExp: time.Second * time.Duration(getEnvInt("ACCESS_TOKEN_EXPIRE_IN", 7200)), RefreshTokenExp: refreshTokenIdleLifetime(), IsGenerateRefresh: true})
+	// every refresh rotates the refresh token and restarts its idle lifetime, see refresh.go
+	manager.SetRefreshTokenCfg(&manage.RefreshingConfig{RefreshTokenExp: refreshTokenIdleLifetime(), IsGenerateRefresh: true, IsResetRefreshTime: true, IsRemoveAccess: true, IsRemoveRefreshing: true})
 
-	manager.MapAccessGenerate(NewJWTAccessGenerate(jwt.SigningMethodRS256, &userStore))
+	accessGenerate := NewJWTAccessGenerate(jwt.SigningMethodRS256, &userStore)
+	accessGenerate.Sessions = &sessionTokenStore
+	manager.MapAccessGenerate(accessGenerate)
 
 	srv.SetInternalErrorHandler(func(err error) (re *errors.Response) {
 		re = &errors.Response{
@@ -112,60 +156,40 @@ func main() {
 		return
 	})
 
-	srv.SetUserAuthorizationHandler(userAuthorizeHandler)
-	srv.SetClientInfoHandler(func(r *http.Request) (clientID, clientSecret string, err error) {
-		clientID, clientSecret, _ = r.BasicAuth()
-		return
-	})
-	srv.ExtensionFieldsHandler = func(ti oauth2.TokenInfo) (fieldsValue map[string]interface{}) {
-		scope := ti.GetScope()
-		if containsScope(scope, "openid") {
-			fieldsValue = map[string]interface{}{}
-			idToken, err := generateIDToken(context.Background(), ti, &userStore)
-			if err != nil {
-				panic(err)
-			}
-			fieldsValue["id_token"] = idToken
-		}
-		return
-	}
+	srv.SetUserAuthorizationHandler(userAuthorizeHandler(&consentStore, &parStore))
+	srv.SetClientInfoHandler(clientInfoHandler(manager))
+	srv.ExtensionFieldsHandler = idTokenFieldsHandler(&userStore)
 
 	mux := http.NewServeMux()
 
 	// http://localhost:8080/authorize?client_id=default&redirect_uri=https%3A%2F%2Fwww.example.com&response_type=code&state=somestate&scope=read_write
-	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
-		err := srv.HandleAuthorizeRequest(w, r)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
-	})
-	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
-		srv.HandleTokenRequest(w, r)
-	})
-
-	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("this is login form"))
-	})
+	mux.HandleFunc("/authorize", authorizeHandler(srv, &parStore))
+	mux.HandleFunc("/par", parHandler(srv, &parStore))
+	mux.HandleFunc("/token", tokenHandler(srv, &codeStore, &refreshTokenStore, dbStore, &deviceCodeStore, &clientStore, &JWTBearerGrant{Issuers: trustedIssuers, Assertions: &assertionStore, Users: &userStore}))
+	mux.HandleFunc("/device_authorization", deviceAuthorizationHandler(srv, &deviceCodeStore))
+
+	mux.HandleFunc("/.well-known/openid-configuration", discoveryHandler(srv))
+	mux.HandleFunc("/.well-known/jwks.json", jwksHandler)
+	mux.HandleFunc("/userinfo", userInfoHandler(srv, &userStore))
+	mux.HandleFunc("/introspect", introspectionHandler(srv))
+	mux.HandleFunc("/revoke", revocationHandler(srv, dbStore))
+	mux.HandleFunc("/register", registrationHandler(srv, &clientStore, &initialAccessTokenStore))
+	mux.HandleFunc("/register/", registrationHandler(srv, &clientStore, &initialAccessTokenStore))
+
+	mux.HandleFunc("/login", loginHandler(idp, &userStore))
+	mux.HandleFunc("/consent", consentHandler(&clientStore, &consentStore))
+	mux.HandleFunc("/logout", logoutHandler(&clientStore, &refreshTokenStore, &sessionTokenStore, dbStore))
+	mux.HandleFunc("/device", deviceHandler(&clientStore, &consentStore, &deviceCodeStore))
+	mux.HandleFunc("/consents", consentsHandler(srv, &clientStore, &consentStore, db))
+	mux.HandleFunc("/consents/", consentsHandler(srv, &clientStore, &consentStore, db))
 
 	mux.HandleFunc("/healthcheck", func(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
 	})
 
-	mux.HandleFunc("/credentials", func(w http.ResponseWriter, r *http.Request) {
-		clientId := uuid.New().String()[:8]
-		clientSecret := uuid.New().String()[:8]
-		err := clientStore.Set(clientId, &models.Client{
-			ID:     clientId,
-			Secret: clientSecret,
-			Domain: "http://localhost:9094",
-		})
-		if err != nil {
-			fmt.Println(err.Error())
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"CLIENT_ID": clientId, "CLIENT_SECRET": clientSecret})
-	})
+	mux.HandleFunc("/admin/clients", adminAuth(srv, adminClientsHandler(&clientStore, db)))
+	mux.HandleFunc("/admin/clients/", adminAuth(srv, adminClientsHandler(&clientStore, db)))
+	mux.HandleFunc("/admin/initial_access_tokens", adminAuth(srv, adminInitialAccessTokensHandler(&initialAccessTokenStore)))
 
 	// mux.HandleFunc("/protected", validateToken(func(w http.ResponseWriter, r *http.Request) {
 	// 	w.Write([]byte("Hello, I'm protected"))
@@ -178,6 +202,11 @@ func main() {
 	if port == "" {
 		port = "80"
 	}
+	if tlsPort := os.Getenv("TLS_PORT"); tlsPort != "" {
+		go func() {
+			log.Fatal(listenMutualTLS(":"+tlsPort, handler))
+		}()
+	}
 	log.Printf("connect to http://localhost:%s/", port)
 	log.Fatal(http.ListenAndServe(":"+port, handler))
 }
@@ -194,30 +223,58 @@ func main() {
 // 	})
 // }
 
-func userAuthorizeHandler(w http.ResponseWriter, r *http.Request) (userID string, err error) {
-	store, err := session.Start(nil, w, r)
-	if err != nil {
-		return
-	}
+func userAuthorizeHandler(consents *ConsentStore, pars *PushedAuthorizationRequestStore) server.UserAuthorizationHandler {
+	return func(w http.ResponseWriter, r *http.Request) (userID string, err error) {
+		store, err := session.Start(nil, w, r)
+		if err != nil {
+			return
+		}
 
-	uid, ok := store.Get("LoggedInUserID") // OR get value from url querystring
-	if !ok {
 		if r.Form == nil {
 			r.ParseForm()
 		}
+		uid, ok := store.Get("LoggedInUserID") // OR get value from url querystring
+		if ok {
+			var reauthenticate bool
+			if reauthenticate, err = requiresLogin(r, store, uid.(string)); err != nil {
+				return
+			}
+			ok = !reauthenticate
+		}
+		if !ok {
+			// silent authentication must not show the login page
+			if hasPrompt(r, "none") {
+				err = ErrLoginRequired
+				return
+			}
 
-		store.Set("ReturnUri", r.Form)
-		store.Save()
+			store.Set("ReturnUri", r.Form)
+			store.Delete("ReturnPath")
+			promptLogin(r, store)
+			store.Save()
 
-		w.Header().Set("Location", "/login")
-		w.WriteHeader(http.StatusFound)
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+
+		// the user stays signed in for following authorization requests of the session
+		userID, err = checkConsent(w, r, store, consents, uid.(string))
+		if userID != "" {
+			// the library passes the same request on to the code and token generators
+			*r = *withAuthentication(r, &Authentication{Nonce: r.FormValue("nonce"), AuthTime: sessionAuthTime(store), SessionID: sessionIDHash(store)})
+			// the login satisfied prompt=login and max_age of this request once, the same request later asks again
+			store.Delete("SignedInRequest")
+			if err = store.Save(); err != nil {
+				return
+			}
+		}
+		// the pushed request is used up once the authorization is granted
+		if requestURI := r.FormValue("request_uri"); userID != "" && requestURI != "" {
+			err = pars.Delete(requestURI)
+		}
 		return
 	}
-
-	userID = uid.(string)
-	store.Delete("LoggedInUserID")
-	store.Save()
-	return
 }
 
 func getEnvInt(name string, defaultValue int) int {
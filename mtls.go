@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ConfirmationClaim key the access token is bound to, the client certificate or the DPoP key
+// https://tools.ietf.org/html/rfc7800#section-3.1
+type ConfirmationClaim struct {
+	// X5TS256 thumbprint of the client certificate https://tools.ietf.org/html/rfc8705#section-3.1
+	X5TS256 string `json:"x5t#S256,omitempty"`
+	// JKT thumbprint of the DPoP key https://datatracker.ietf.org/doc/html/rfc9449#section-6.1
+	JKT string `json:"jkt,omitempty"`
+}
+
+// clientCAs verify certificates of tls_client_auth clients, it is set up in main
+var clientCAs *x509.CertPool
+
+// loadClientCAs reads TLS_CLIENT_CA_FILE, without it only self_signed_tls_client_auth is possible
+func loadClientCAs() (*x509.CertPool, error) {
+	filename := os.Getenv("TLS_CLIENT_CA_FILE")
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", filename)
+	}
+	return pool, nil
+}
+
+// listenMutualTLS serves the handler on TLS listener which asks for client certificates.
+// The certificates are not verified by the listener, clients are authenticated per their registration.
+func listenMutualTLS(addr string, handler http.Handler) error {
+	s := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: &tls.Config{ClientAuth: tls.RequestClientCert, MinVersion: tls.VersionTLS12},
+	}
+	log.Printf("connect to https://localhost%s/ with client certificate", addr)
+	return s.ListenAndServeTLS(os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"))
+}
+
+// listenerBaseURL returns the configured base URL of the listener which received the request,
+// MTLS_BASE_URL for the TLS listener and ISSUER_URL otherwise, the host of the request is chosen by the caller
+func listenerBaseURL(r *http.Request) string {
+	if r.TLS != nil {
+		if base := os.Getenv("MTLS_BASE_URL"); base != "" {
+			return strings.TrimRight(base, "/")
+		}
+	}
+	return getIssuer()
+}
+
+// clientCertificate returns certificate the client presented on the TLS connection
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// certificateThumbprint base64url encoded SHA-256 of the DER certificate
+func certificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// verifyClientCertificate authenticates the client by its certificate
+// https://tools.ietf.org/html/rfc8705#section-2
+func verifyClientCertificate(r *http.Request, client *Client) error {
+	cert := clientCertificate(r)
+	if cert == nil {
+		return fmt.Errorf("no client certificate")
+	}
+
+	switch client.TokenEndpointAuthMethod {
+	case "tls_client_auth":
+		if clientCAs == nil {
+			return fmt.Errorf("TLS_CLIENT_CA_FILE is not configured")
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:         clientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return err
+		}
+		if client.TLSClientAuthSubjectDN == "" || cert.Subject.String() != client.TLSClientAuthSubjectDN {
+			return fmt.Errorf("subject %s does not match", cert.Subject.String())
+		}
+	case "self_signed_tls_client_auth":
+		if client.TLSClientCertificateThumbprint == "" || certificateThumbprint(cert) != client.TLSClientCertificateThumbprint {
+			return fmt.Errorf("certificate is not pinned for the client")
+		}
+	default:
+		return fmt.Errorf("client %s does not use certificates", client.ID)
+	}
+	return nil
+}
+
+// usesTLSClientAuth checks the auth method of the client is one of the mutual TLS methods
+func usesTLSClientAuth(method string) bool {
+	return method == "tls_client_auth" || method == "self_signed_tls_client_auth"
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/models"
+	"gopkg.in/oauth2.v3/server"
+	"gopkg.in/oauth2.v3/store"
+)
+
+// createTestCertificate issues client certificate for the common name, it is self-signed when parent is nil
+func createTestCertificate(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("[%v] Failed to generate key", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("[%v] Failed to create certificate", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("[%v] Failed to parse certificate", err)
+	}
+	return cert, key
+}
+
+func TestVerifyClientCertificate(t *testing.T) {
+	ca, caKey := createTestCertificate(t, "Example CA", true, nil, nil)
+	signed, _ := createTestCertificate(t, "svc", false, ca, caKey)
+	selfSigned, _ := createTestCertificate(t, "svc", false, nil, nil)
+	other, _ := createTestCertificate(t, "svc", false, nil, nil)
+	clientCAs = x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	defer func() { clientCAs = nil }()
+
+	pinned := &Client{ID: "pinned", TokenEndpointAuthMethod: "self_signed_tls_client_auth", TLSClientCertificateThumbprint: certificateThumbprint(selfSigned)}
+	subject := &Client{ID: "subject", TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSubjectDN: "CN=svc"}
+	cases := []struct {
+		name   string
+		client *Client
+		cert   *x509.Certificate
+		valid  bool
+	}{
+		{"pinned certificate", pinned, selfSigned, true},
+		{"other self-signed certificate", pinned, other, false},
+		{"no certificate", pinned, nil, false},
+		{"certificate of the CA", subject, signed, true},
+		{"self-signed certificate with subject", subject, selfSigned, false},
+		{"other subject", &Client{ID: "other", TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSubjectDN: "CN=other"}, signed, false},
+		{"client with secret", &Client{ID: "secret", TokenEndpointAuthMethod: "client_secret_basic"}, signed, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/token", nil)
+		if c.cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.cert}}
+		}
+		if err := verifyClientCertificate(r, c.client); (err == nil) != c.valid {
+			t.Errorf("[%s] expected valid %v, got %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestValidateBearerTokenCertificateBinding(t *testing.T) {
+	defer useTestSigningKey(t)()
+
+	cert, _ := createTestCertificate(t, "svc", false, nil, nil)
+	other, _ := createTestCertificate(t, "svc", false, nil, nil)
+	m := manage.NewDefaultManager()
+	tokens, _ := store.NewMemoryTokenStore()
+	m.MapTokenStorage(tokens)
+	srv := server.NewDefaultServer(m)
+	bound := createTestAccessToken(t, tokens, &models.Token{ClientID: "svc", Scope: "orders:read"}, &JWTAccessClaims{Confirmation: &ConfirmationClaim{X5TS256: certificateThumbprint(cert)}})
+	unbound := createTestAccessToken(t, tokens, &models.Token{ClientID: "svc", Scope: "orders:read"}, nil)
+
+	cases := []struct {
+		name   string
+		access string
+		cert   *x509.Certificate
+		valid  bool
+	}{
+		{"same certificate", bound, cert, true},
+		{"other certificate", bound, other, false},
+		{"without TLS", bound, nil, false},
+		{"unbound token over TLS", unbound, other, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+c.access)
+		if c.cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.cert}}
+		}
+		w := httptest.NewRecorder()
+		if _, ok := validateBearerToken(w, r, srv); ok != c.valid {
+			t.Errorf("[%s] expected valid %v, got %d %s", c.name, c.valid, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// requestURIPrefix https://datatracker.ietf.org/doc/html/rfc9126#section-2.2
+const requestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+// PushedAuthorizationRequest authorization request parameters the client pushed, only hash of the request_uri is stored
+type PushedAuthorizationRequest struct {
+	RequestURIHash string `gorm:"primary_key"`
+	ClientID       string
+	// Form url encoded parameters of the authorization request
+	Form      string `gorm:"type:text"`
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+type PushedAuthorizationRequestStore struct {
+	DB *database.DB
+}
+
+func (s *PushedAuthorizationRequestStore) AutoMigrate() error {
+	return s.DB.AutoMigrate(&PushedAuthorizationRequest{})
+}
+
+func (s *PushedAuthorizationRequestStore) Create(req *PushedAuthorizationRequest) error {
+	// requests which were never used are dropped here instead of a separate gc
+	if err := s.DB.Client().Where("expires_at < ?", time.Now()).Delete(&PushedAuthorizationRequest{}).Error; err != nil {
+		return err
+	}
+	return s.DB.Client().Create(req).Error
+}
+
+func (s *PushedAuthorizationRequestStore) Get(requestURI string) (req *PushedAuthorizationRequest, err error) {
+	var p PushedAuthorizationRequest
+	res := s.DB.Client().First(&p, &PushedAuthorizationRequest{RequestURIHash: hashToken(requestURI)})
+	if res.RecordNotFound() {
+		return
+	}
+	err = res.Error
+	if err != nil {
+		return
+	}
+	req = &p
+	return
+}
+
+func (s *PushedAuthorizationRequestStore) Delete(requestURI string) error {
+	return s.DB.Client().Delete(&PushedAuthorizationRequest{RequestURIHash: hashToken(requestURI)}).Error
+}
+
+// pushedRequestLifetime has to cover the sign in and consent, the request_uri is used again when the user returns
+func pushedRequestLifetime() time.Duration {
+	return time.Second * time.Duration(getEnvInt("PAR_REQUEST_LIFETIME", 300))
+}
+
+// PushedAuthorizationResponse https://datatracker.ietf.org/doc/html/rfc9126#section-2.2
+type PushedAuthorizationResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int64  `json:"expires_in"`
+}
+
+// parHandler validates the authorization request of the authenticated client and stores it for /authorize
+// https://datatracker.ietf.org/doc/html/rfc9126#section-2.1
+func parHandler(srv *server.Server, pars *PushedAuthorizationRequestStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		cli, err := authenticateClient(r, srv.Manager)
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+		if r.PostFormValue("request_uri") != "" {
+			writeErrorResponse(w, srv, errors.ErrInvalidRequest)
+			return
+		}
+
+		form := url.Values{}
+		for key, values := range r.PostForm {
+			switch key {
+			case "client_secret", "client_assertion", "client_assertion_type":
+			default:
+				form[key] = values
+			}
+		}
+		form.Set("client_id", cli.GetID())
+		req := r.WithContext(r.Context())
+		req.Form = form
+		if err := resolveRequestObject(req, srv); err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+		if err := validatePushedRequest(req, srv); err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+
+		requestURI, err := generateSecret()
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+		requestURI = requestURIPrefix + requestURI
+		p := &PushedAuthorizationRequest{
+			RequestURIHash: hashToken(requestURI),
+			ClientID:       cli.GetID(),
+			Form:           req.Form.Encode(),
+			ExpiresAt:      time.Now().Add(pushedRequestLifetime()),
+		}
+		if err := pars.Create(p); err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, &PushedAuthorizationResponse{
+			RequestURI: requestURI,
+			ExpiresIn:  int64(pushedRequestLifetime().Seconds()),
+		})
+	}
+}
+
+// validatePushedRequest runs the checks of /authorize, which are possible before the user is involved
+func validatePushedRequest(r *http.Request, srv *server.Server) error {
+	if err := validateAuthorizeRequest(r, srv); err == errors.ErrInvalidRedirectURI {
+		// the library error has no OAuth2 error code
+		return errors.ErrInvalidRequest
+	} else if err != nil {
+		return err
+	}
+	req, err := srv.ValidationAuthorizeRequest(r)
+	if err != nil {
+		return err
+	}
+	gt := oauth2.AuthorizationCode
+	if req.ResponseType == oauth2.Token {
+		gt = oauth2.Implicit
+	}
+	if fn := srv.ClientAuthorizedHandler; fn != nil {
+		if allowed, err := fn(req.ClientID, gt); err != nil {
+			return err
+		} else if !allowed {
+			return errors.ErrUnauthorizedClient
+		}
+	}
+	return nil
+}
+
+// resolvePushedRequest replaces parameters of the authorization request with the pushed ones,
+// only client_id and request_uri are kept, so the client can not change the validated request
+// https://datatracker.ietf.org/doc/html/rfc9126#section-4
+func resolvePushedRequest(r *http.Request, srv *server.Server, pars *PushedAuthorizationRequestStore) error {
+	if r.Form == nil {
+		r.ParseForm()
+	}
+	clientID, requestURI := r.FormValue("client_id"), r.FormValue("request_uri")
+	if requestURI == "" {
+		cli, err := srv.Manager.GetClient(clientID)
+		if err != nil {
+			return err
+		}
+		if client, ok := cli.(*Client); ok && client.RequirePushedAuthorizationRequests {
+			return ErrPushedRequestRequired
+		}
+		return nil
+	}
+
+	p, err := pars.Get(requestURI)
+	if err != nil {
+		return err
+	}
+	if p == nil || p.ClientID != clientID || time.Now().After(p.ExpiresAt) {
+		return ErrInvalidRequestURI
+	}
+	form, err := url.ParseQuery(p.Form)
+	if err != nil {
+		return err
+	}
+	form.Set("request_uri", requestURI)
+	r.Form = form
+	return nil
+}
+
+// authorizeReturnQuery query of the authorization request the user returns to after sign in or consent,
+// pushed requests are resumed by their request_uri to keep the parameters out of the browser history
+func authorizeReturnQuery(form url.Values) string {
+	if requestURI := form.Get("request_uri"); requestURI != "" {
+		return url.Values{"client_id": {form.Get("client_id")}, "request_uri": {requestURI}}.Encode()
+	}
+	return form.Encode()
+}
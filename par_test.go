@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/server"
+)
+
+func TestResolvePushedRequest(t *testing.T) {
+	db := database.NewDBWithString("sqlite3://:memory:")
+	clients := ClientStore{DB: db}
+	pars := PushedAuthorizationRequestStore{DB: db}
+	for _, migrate := range []func() error{clients.AutoMigrate, pars.AutoMigrate} {
+		if err := migrate(); err != nil {
+			t.Fatalf("[%v] Failed to automigrate", err)
+		}
+	}
+	for _, cli := range []*Client{
+		{ID: "app", RedirectURIs: database.StringList{"https://app.example.com/cb"}, Scopes: database.StringList{"openid"}},
+		{ID: "other", RedirectURIs: database.StringList{"https://other.example.com/cb"}, Scopes: database.StringList{"openid"}},
+	} {
+		if err := clients.Create(cli); err != nil {
+			t.Fatalf("[%v] Failed to create client", err)
+		}
+	}
+	m := manage.NewDefaultManager()
+	m.MapClientStorage(&clients)
+	srv := server.NewDefaultServer(m)
+	handler := parHandler(srv, &pars)
+
+	push := func() string {
+		form := url.Values{
+			"client_id":             {"app"},
+			"response_type":         {"code"},
+			"redirect_uri":          {"https://app.example.com/cb"},
+			"scope":                 {"openid"},
+			"state":                 {"xyz"},
+			"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+			"code_challenge_method": {"S256"},
+		}
+		r := httptest.NewRequest("POST", "/par", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		var res PushedAuthorizationResponse
+		json.NewDecoder(w.Body).Decode(&res)
+		if w.Code != http.StatusCreated || !strings.HasPrefix(res.RequestURI, requestURIPrefix) {
+			t.Fatalf("pushed request should be stored, got %d", w.Code)
+		}
+		return res.RequestURI
+	}
+	resolve := func(clientID, requestURI string) (*http.Request, error) {
+		r := httptest.NewRequest("GET", "/authorize?"+url.Values{"client_id": {clientID}, "request_uri": {requestURI}, "state": {"changed"}}.Encode(), nil)
+		return r, resolvePushedRequest(r, srv, &pars)
+	}
+
+	requestURI := push()
+	r, err := resolve("app", requestURI)
+	if err != nil {
+		t.Fatalf("[%v] Failed to resolve pushed request", err)
+	}
+	if r.FormValue("state") != "xyz" || r.FormValue("redirect_uri") != "https://app.example.com/cb" {
+		t.Errorf("parameters should be the pushed ones, got %v", r.Form)
+	}
+	// the user returns from sign in with the same request_uri
+	if _, err := resolve("app", requestURI); err != nil {
+		t.Errorf("[%v] request_uri should be usable until the authorization is granted", err)
+	}
+	if _, err := resolve("other", requestURI); err != ErrInvalidRequestURI {
+		t.Errorf("request_uri of other client should be refused, got %v", err)
+	}
+
+	// the grant uses the request up
+	if err := pars.Delete(requestURI); err != nil {
+		t.Fatalf("[%v] Failed to delete pushed request", err)
+	}
+	if _, err := resolve("app", requestURI); err != ErrInvalidRequestURI {
+		t.Errorf("used request_uri should be refused, got %v", err)
+	}
+
+	expired := push()
+	if err := db.Client().Model(&PushedAuthorizationRequest{}).Where("request_uri_hash = ?", hashToken(expired)).Update("expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatalf("[%v] Failed to expire pushed request", err)
+	}
+	if _, err := resolve("app", expired); err != ErrInvalidRequestURI {
+		t.Errorf("expired request_uri should be refused, got %v", err)
+	}
+	if _, err := resolve("app", "urn:ietf:params:oauth:request_uri:unknown"); err != ErrInvalidRequestURI {
+		t.Errorf("unknown request_uri should be refused, got %v", err)
+	}
+}
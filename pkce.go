@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"regexp"
+)
+
+// https://tools.ietf.org/html/rfc7636
+const (
+	PKCEMethodPlain = "plain"
+	PKCEMethodS256  = "S256"
+)
+
+// code_challenge and code_verifier share the same syntax
+var pkceValuePattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// validateCodeChallenge checks the PKCE parameters of the authorization request against the client settings
+func validateCodeChallenge(cli *Client, challenge, method string) error {
+	if challenge == "" {
+		if method != "" {
+			return ErrInvalidCodeChallenge
+		}
+		if cli != nil && cli.RequirePKCE {
+			return ErrCodeChallengeRequired
+		}
+		return nil
+	}
+
+	if method == "" {
+		method = PKCEMethodPlain
+	}
+	if method != PKCEMethodPlain && method != PKCEMethodS256 {
+		return ErrUnsupportedCodeChallengeMethod
+	}
+	if method == PKCEMethodPlain && cli != nil && cli.PKCES256Only {
+		return ErrUnsupportedCodeChallengeMethod
+	}
+	if !pkceValuePattern.MatchString(challenge) {
+		return ErrInvalidCodeChallenge
+	}
+	return nil
+}
+
+// verifyCodeVerifier https://tools.ietf.org/html/rfc7636#section-4.6
+func verifyCodeVerifier(challenge, method, verifier string) bool {
+	if !pkceValuePattern.MatchString(verifier) {
+		return false
+	}
+
+	computed := verifier
+	if method == PKCEMethodS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		computed = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
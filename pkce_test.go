@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+// https://tools.ietf.org/html/rfc7636#appendix-B
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	if !verifyCodeVerifier(testCodeChallenge, PKCEMethodS256, testCodeVerifier) {
+		t.Errorf("S256 verifier should match the challenge")
+	}
+	if verifyCodeVerifier(testCodeChallenge, PKCEMethodS256, testCodeChallenge) {
+		t.Errorf("S256 challenge used as verifier should not match")
+	}
+	if !verifyCodeVerifier(testCodeVerifier, PKCEMethodPlain, testCodeVerifier) {
+		t.Errorf("plain verifier should match the same challenge")
+	}
+	if verifyCodeVerifier("short", PKCEMethodPlain, "short") {
+		t.Errorf("verifier shorter than 43 characters should be rejected")
+	}
+}
+
+func TestValidateCodeChallenge(t *testing.T) {
+	optional := &Client{ID: "optional"}
+	required := &Client{ID: "required", RequirePKCE: true, PKCES256Only: true}
+
+	cases := []struct {
+		client    *Client
+		challenge string
+		method    string
+		err       error
+	}{
+		{optional, "", "", nil},
+		{optional, testCodeChallenge, "", nil},
+		{optional, testCodeChallenge, PKCEMethodPlain, nil},
+		{optional, "", PKCEMethodS256, ErrInvalidCodeChallenge},
+		{optional, "too-short", PKCEMethodS256, ErrInvalidCodeChallenge},
+		{optional, testCodeChallenge, "S512", ErrUnsupportedCodeChallengeMethod},
+		{required, "", "", ErrCodeChallengeRequired},
+		{required, testCodeChallenge, "", ErrUnsupportedCodeChallengeMethod},
+		{required, testCodeChallenge, PKCEMethodPlain, ErrUnsupportedCodeChallengeMethod},
+		{required, testCodeChallenge, PKCEMethodS256, nil},
+	}
+	for _, c := range cases {
+		if err := validateCodeChallenge(c.client, c.challenge, c.method); err != c.err {
+			t.Errorf("[%s %q %q] expected %v, got %v", c.client.ID, c.challenge, c.method, c.err, err)
+		}
+	}
+}
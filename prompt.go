@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-session/session"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+// validatePrompt refuses prompt=none together with the prompts which need the user
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+func validatePrompt(r *http.Request) error {
+	if hasPrompt(r, "none") && (hasPrompt(r, "login") || hasPrompt(r, "consent") || hasPrompt(r, "select_account")) {
+		return errors.ErrInvalidRequest
+	}
+	if maxAge := r.FormValue("max_age"); maxAge != "" {
+		if v, err := strconv.Atoi(maxAge); err != nil || v < 0 {
+			return errors.ErrInvalidRequest
+		}
+	}
+	return nil
+}
+
+// promptLogin records the authorization request the user is sent to sign in for,
+// the login moves it to SignedInRequest, which satisfies prompt=login and max_age of the request
+func promptLogin(r *http.Request, store session.Store) {
+	store.Set("LoginRequest", hashToken(r.Form.Encode()))
+	store.Delete("SignedInRequest")
+}
+
+// signedInForRequest checks the user signed in after being sent to the login page by this authorization request
+func signedInForRequest(r *http.Request, store session.Store) bool {
+	request, ok := store.Get("SignedInRequest")
+	return ok && request == hashToken(r.Form.Encode())
+}
+
+// sessionIDHash identifies the login session in ID tokens and refresh token families, the session cookie value is not exposed
+func sessionIDHash(store session.Store) string {
+	return hashToken(store.SessionID())
+}
+
+func sessionAuthTime(store session.Store) int64 {
+	v, _ := store.Get("AuthTime")
+	authTime, _ := v.(int64)
+	return authTime
+}
+
+// requiresLogin checks whether the signed in user has to sign in again for prompt=login, max_age or id_token_hint
+func requiresLogin(r *http.Request, store session.Store, userID string) (bool, error) {
+	fresh := signedInForRequest(r, store)
+
+	if hint := r.FormValue("id_token_hint"); hint != "" {
+		subject, err := idTokenHintSubject(hint, r.FormValue("client_id"))
+		if err != nil {
+			log.Println("Invalid id_token_hint:", err)
+			return false, errors.ErrInvalidRequest
+		}
+		if subject != userID {
+			// the user signed in for the request as somebody else than the client expected
+			if fresh || hasPrompt(r, "none") {
+				return false, ErrLoginRequired
+			}
+			return true, nil
+		}
+	}
+	if fresh {
+		return false, nil
+	}
+
+	if hasPrompt(r, "login") {
+		return true, nil
+	}
+	if maxAge := r.FormValue("max_age"); maxAge != "" {
+		// max_age=0 is prompt=login, the seconds of the sign in time can not tell it apart from an earlier login
+		seconds, _ := strconv.ParseInt(maxAge, 10, 64)
+		if seconds == 0 || time.Now().Unix()-sessionAuthTime(store) > seconds {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// idTokenHintSubject returns the user of ID token issued to the client
+func idTokenHintSubject(hint, clientID string) (string, error) {
+	claims, err := parseIDTokenHint(hint)
+	if err != nil {
+		return "", err
+	}
+	if claims.Audience != clientID {
+		return "", fmt.Errorf("ID token was issued to %s", claims.Audience)
+	}
+	return claims.Subject, nil
+}
+
+// parseIDTokenHint verifies the signature of ID token issued by this server, expired tokens are accepted as hints.
+// Access tokens and introspection responses are signed with the same key, they differ in typ and iss.
+func parseIDTokenHint(hint string) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	parser := &jwt.Parser{ValidMethods: []string{idTokenSigningMethod.Alg()}, SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(hint, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return getPublicKey(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if typ, _ := token.Header["typ"].(string); typ != "" && typ != "JWT" {
+		return nil, fmt.Errorf("the token of type %s is not an ID token", typ)
+	}
+	if claims.Issuer == "" || claims.Issuer != getIssuer() {
+		return nil, fmt.Errorf("the ID token was not issued by this server")
+	}
+	return claims, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-session/session"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+// signTestIDTokenHint signs the claims like the ID tokens, typ other than JWT is set in the header
+func signTestIDTokenHint(t *testing.T, typ string, claims jwt.Claims) string {
+	token := jwt.NewWithClaims(idTokenSigningMethod, claims)
+	if typ != "" {
+		token.Header["typ"] = typ
+	}
+	signed, err := signToken(token)
+	if err != nil {
+		t.Fatalf("[%v] Failed to sign id_token_hint", err)
+	}
+	return signed
+}
+
+func TestRequiresLogin(t *testing.T) {
+	os.Setenv("ISSUER_URL", "https://auth.example.com")
+	defer os.Unsetenv("ISSUER_URL")
+	defer useTestSigningKey(t)()
+	hint := func(subject string) string {
+		return signTestIDTokenHint(t, "", &IDTokenClaims{Issuer: "https://auth.example.com", Audience: "app", Subject: subject})
+	}
+	// the access token of the user has the same aud and sub as the ID token
+	accessToken := signTestIDTokenHint(t, accessTokenJWTType, &JWTAccessClaims{StandardClaims: jwt.StandardClaims{Issuer: "https://auth.example.com", Audience: "app", Subject: "u1"}})
+	otherIssuer := signTestIDTokenHint(t, "", &IDTokenClaims{Issuer: "https://other.example.com", Audience: "app", Subject: "u1"})
+
+	cases := []struct {
+		name    string
+		query   string
+		authAge time.Duration
+		fresh   bool
+		login   bool
+		err     error
+	}{
+		{"signed in", "", time.Hour, false, false, nil},
+		{"prompt=login", "prompt=login", time.Minute, false, true, nil},
+		{"prompt=login after login", "prompt=login", 0, true, false, nil},
+		{"max_age", "max_age=3600", time.Minute, false, false, nil},
+		{"max_age exceeded", "max_age=60", time.Hour, false, true, nil},
+		{"max_age=0", "max_age=0", time.Minute, false, true, nil},
+		{"max_age=0 signed in just now", "max_age=0", 0, false, true, nil},
+		{"max_age=0 after login", "max_age=0", 0, true, false, nil},
+		{"id_token_hint", "id_token_hint=" + hint("u1"), time.Hour, false, false, nil},
+		{"id_token_hint of other user", "id_token_hint=" + hint("u2"), time.Hour, false, true, nil},
+		{"id_token_hint of other user after login", "id_token_hint=" + hint("u2"), 0, true, false, ErrLoginRequired},
+		{"id_token_hint of other user prompt=none", "prompt=none&id_token_hint=" + hint("u2"), time.Hour, false, false, ErrLoginRequired},
+		{"invalid id_token_hint", "id_token_hint=abc", time.Hour, false, false, errors.ErrInvalidRequest},
+		{"access token as id_token_hint", "id_token_hint=" + accessToken, time.Hour, false, false, errors.ErrInvalidRequest},
+		{"id_token_hint of other issuer", "id_token_hint=" + otherIssuer, time.Hour, false, false, errors.ErrInvalidRequest},
+		{"prompt=none", "prompt=none", time.Hour, false, false, nil},
+		{"prompt=none max_age exceeded", "prompt=none&max_age=60", time.Hour, false, true, nil},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/authorize?response_type=code&client_id=app&"+c.query, nil)
+		r.ParseForm()
+		store, err := session.Start(context.Background(), httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatalf("[%v] Failed to start session", err)
+		}
+		store.Set("AuthTime", time.Now().Add(-c.authAge).Unix())
+		if c.fresh {
+			promptLogin(r, store)
+			request, _ := store.Get("LoginRequest")
+			store.Set("SignedInRequest", request)
+		}
+
+		login, err := requiresLogin(r, store, "u1")
+		if login != c.login || err != c.err {
+			t.Errorf("[%s] expected %v %v, got %v %v", c.name, c.login, c.err, login, err)
+		}
+	}
+}
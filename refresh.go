@@ -0,0 +1,147 @@
+package main
+
+import (
+	errs "errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3"
+)
+
+// RefreshToken issued refresh token and the family it was rotated in,
+// every refresh issues new token of the family and marks the presented one as used
+type RefreshToken struct {
+	Token    string `gorm:"primary_key;type:varchar(512)"`
+	FamilyID string `gorm:"index"`
+	ClientID string
+	UserID   string
+	// FamilyCreatedAt is the time of the original grant, the absolute lifetime is counted from it
+	FamilyCreatedAt time.Time
+	UsedAt          *time.Time
+	// DPoPJKT key the refresh token of public client is bound to, see dpop.go
+	DPoPJKT string
+	// SessionID hash of the login session the family was granted in, logout can revoke it
+	SessionID string `gorm:"index"`
+	CreatedAt time.Time
+}
+
+type RefreshTokenStore struct {
+	DB *database.DB
+}
+
+func (s *RefreshTokenStore) AutoMigrate() error {
+	return s.DB.AutoMigrate(&RefreshToken{})
+}
+
+func (s *RefreshTokenStore) Get(token string) (t *RefreshToken, err error) {
+	var rt RefreshToken
+	res := s.DB.Client().First(&rt, &RefreshToken{Token: token})
+	if res.RecordNotFound() {
+		return
+	}
+	err = res.Error
+	if err != nil {
+		return
+	}
+	t = &rt
+	return
+}
+
+// ErrRefreshTokenUsed is returned by Rotate when the previous token was used by another refresh meanwhile
+var ErrRefreshTokenUsed = errs.New("refresh token was used already")
+
+// Rotate records the refresh token of ti, it continues the family of prev or starts new one when prev is nil.
+// The token is bound to the DPoP key jkt unless it is empty, sessionID of new family is the login session of the grant.
+// prev is marked as used together with recording the new token once it was issued, the update is conditional,
+// so only one of concurrent refreshes with the same token succeeds.
+func (s *RefreshTokenStore) Rotate(prev *RefreshToken, ti oauth2.TokenInfo, jkt, sessionID string) error {
+	// families past the absolute lifetime can not be refreshed anymore, so they are dropped here
+	if lifetime := refreshTokenAbsoluteLifetime(); lifetime > 0 {
+		expired := time.Now().Add(-lifetime)
+		if err := s.DB.Client().Where("family_created_at < ?", expired).Delete(&RefreshToken{}).Error; err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	rt := &RefreshToken{
+		Token:           ti.GetRefresh(),
+		FamilyID:        uuid.New().String(),
+		ClientID:        ti.GetClientID(),
+		UserID:          ti.GetUserID(),
+		FamilyCreatedAt: now,
+		DPoPJKT:         jkt,
+		SessionID:       sessionID,
+	}
+	if prev == nil {
+		return s.DB.Client().Create(rt).Error
+	}
+	rt.FamilyID = prev.FamilyID
+	rt.FamilyCreatedAt = prev.FamilyCreatedAt
+	rt.SessionID = prev.SessionID
+
+	tx := s.DB.Client().Begin()
+	res := tx.Model(&RefreshToken{}).Where("token = ? AND used_at IS NULL", prev.Token).Update("used_at", now)
+	err := res.Error
+	if err == nil && res.RowsAffected != 1 {
+		err = ErrRefreshTokenUsed
+	}
+	if err == nil {
+		err = tx.Create(rt).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// RevokeFamily removes the tokens of the family from the token store, the records are kept as used
+// so another use of any of them is still detected
+func (s *RefreshTokenStore) RevokeFamily(familyID string, tokenStore oauth2.TokenStore) error {
+	var tokens []RefreshToken
+	if err := s.DB.Client().Where(&RefreshToken{FamilyID: familyID}).Find(&tokens).Error; err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		ti, err := tokenStore.GetByRefresh(t.Token)
+		if err != nil {
+			return err
+		}
+		if ti != nil {
+			if err := removeToken(tokenStore, ti); err != nil {
+				return err
+			}
+		}
+	}
+	return s.DB.Client().Model(&RefreshToken{}).Where("family_id = ? AND used_at IS NULL", familyID).Update("used_at", time.Now()).Error
+}
+
+// RevokeSession revokes the families granted in the login session
+func (s *RefreshTokenStore) RevokeSession(sessionID string, tokenStore oauth2.TokenStore) error {
+	if sessionID == "" {
+		// the zero value would match every token
+		return nil
+	}
+	var familyIDs []string
+	if err := s.DB.Client().Model(&RefreshToken{}).Where(&RefreshToken{SessionID: sessionID}).Pluck("DISTINCT family_id", &familyIDs).Error; err != nil {
+		return err
+	}
+	for _, familyID := range familyIDs {
+		if err := s.RevokeFamily(familyID, tokenStore); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshTokenAbsoluteLifetime limits how long the family can be refreshed since the original grant, zero disables it
+func refreshTokenAbsoluteLifetime() time.Duration {
+	return time.Second * time.Duration(getEnvInt("REFRESH_TOKEN_ABSOLUTE_LIFETIME", 2592000))
+}
+
+// refreshTokenIdleLifetime expires refresh tokens not used for the duration, every refresh issues token with the full idle lifetime
+func refreshTokenIdleLifetime() time.Duration {
+	return time.Second * time.Duration(getEnvInt("REFRESH_TOKEN_IDLE_LIFETIME", 604800))
+}
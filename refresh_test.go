@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/models"
+	"gopkg.in/oauth2.v3/server"
+	"gopkg.in/oauth2.v3/store"
+)
+
+func TestRefreshTokenStoreRotate(t *testing.T) {
+	db := database.NewDBWithString("sqlite3://:memory:")
+	s := RefreshTokenStore{DB: db}
+	if err := s.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	if err := s.Rotate(nil, &models.Token{ClientID: "app", Refresh: "rt1"}, "", "s1"); err != nil {
+		t.Fatalf("[%v] Failed to record refresh token", err)
+	}
+	prev, err := s.Get("rt1")
+	if err != nil || prev == nil || prev.UsedAt != nil {
+		t.Fatalf("[%v] new family should be recorded unused", err)
+	}
+
+	if err := s.Rotate(prev, &models.Token{ClientID: "app", Refresh: "rt2"}, "", ""); err != nil {
+		t.Errorf("[%v] first rotation should succeed", err)
+	}
+	if err := s.Rotate(prev, &models.Token{ClientID: "app", Refresh: "rt3"}, "", ""); err != ErrRefreshTokenUsed {
+		t.Errorf("concurrent rotation should be detected, got %v", err)
+	}
+
+	if rt, _ := s.Get("rt1"); rt == nil || rt.UsedAt == nil {
+		t.Errorf("rotated token should be marked as used")
+	}
+	if rt, _ := s.Get("rt2"); rt == nil || rt.FamilyID != prev.FamilyID || rt.SessionID != "s1" {
+		t.Errorf("rotated token should continue the family, got %+v", rt)
+	}
+	if rt, _ := s.Get("rt3"); rt != nil {
+		t.Errorf("token of the concurrent rotation should not be recorded")
+	}
+}
+
+func TestTokenHandlerRefreshRetry(t *testing.T) {
+	defer useTestSigningKey(t)()
+
+	id := newTestIDServer()
+	defer id.Close()
+	db := database.NewDBWithString("sqlite3://:memory:")
+	users := UserStore{DB: db, ID: &IDClient{URL: id.URL}}
+	clients := ClientStore{DB: db}
+	refreshTokens := RefreshTokenStore{DB: db}
+	for _, migrate := range []func() error{users.AutoMigrate, clients.AutoMigrate, refreshTokens.AutoMigrate} {
+		if err := migrate(); err != nil {
+			t.Fatalf("[%v] Failed to automigrate", err)
+		}
+	}
+	user, err := users.CreateUserWithAccount(context.Background(), "abcd1234", "john.doe@example.com", "idp")
+	if err != nil {
+		t.Fatalf("[%v] Failed to create user", err)
+	}
+	cli := &Client{ID: "app"}
+	if err := cli.SetSecret("secret"); err != nil {
+		t.Fatalf("[%v] Failed to set secret", err)
+	}
+	if err := clients.Create(cli); err != nil {
+		t.Fatalf("[%v] Failed to create client", err)
+	}
+
+	m := manage.NewDefaultManager()
+	m.MapClientStorage(&clients)
+	tokens, _ := store.NewMemoryTokenStore()
+	m.MapTokenStorage(tokens)
+	m.MapAccessGenerate(NewJWTAccessGenerate(jwt.SigningMethodRS256, &users))
+	m.SetPasswordTokenCfg(&manage.Config{AccessTokenExp: manage.DefaultPasswordTokenCfg.AccessTokenExp, RefreshTokenExp: refreshTokenIdleLifetime(), IsGenerateRefresh: true})
+	m.SetRefreshTokenCfg(&manage.RefreshingConfig{RefreshTokenExp: refreshTokenIdleLifetime(), IsGenerateRefresh: true, IsResetRefreshTime: true, IsRemoveAccess: true, IsRemoveRefreshing: true})
+	srv := server.NewDefaultServer(m)
+	srv.SetClientInfoHandler(clientInfoHandler(m))
+	srv.SetPasswordAuthorizationHandler(func(username, password string) (string, error) {
+		return user.ID, nil
+	})
+	handler := tokenHandler(srv, &AuthorizationCodeStore{DB: db}, &refreshTokens, tokens, nil, &clients, nil)
+
+	request := func(form url.Values) (int, map[string]interface{}) {
+		r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("app", "secret")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		data := map[string]interface{}{}
+		json.NewDecoder(w.Body).Decode(&data)
+		return w.Code, data
+	}
+
+	code, data := request(url.Values{"grant_type": {"password"}, "username": {"john.doe@example.com"}, "password": {"password"}})
+	first, _ := data["refresh_token"].(string)
+	if code != http.StatusOK || first == "" {
+		t.Fatalf("password grant should issue refresh token, got %d %v", code, data)
+	}
+
+	// the user can not get the admin scope, the refresh fails after the token was verified
+	if code, data := request(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first}, "scope": {"admin"}}); code != http.StatusBadRequest || data["error"] != "invalid_scope" {
+		t.Fatalf("refresh with admin scope should fail, got %d %v", code, data)
+	}
+	code, data = request(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first}})
+	second, _ := data["refresh_token"].(string)
+	if code != http.StatusOK || second == "" || second == first {
+		t.Fatalf("retry of the failed refresh should succeed, got %d %v", code, data)
+	}
+
+	// the rotated token presented again revokes the family
+	if code, data := request(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first}}); data["error"] != "invalid_grant" {
+		t.Errorf("reuse of rotated refresh token should fail, got %d %v", code, data)
+	}
+	if code, data := request(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {second}}); code == http.StatusOK {
+		t.Errorf("family should be revoked after reuse, got %d %v", code, data)
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/graphql-services/oauth/database"
+	"github.com/lestrrat/go-jwx/jwk"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// registrationGrantTypes grant types supported for registered clients, registrationAllowedGrantTypes limits them
+var registrationGrantTypes = []string{"authorization_code", "implicit", "password", "client_credentials", "refresh_token", deviceCodeGrantType, tokenExchangeGrantType, jwtBearerGrantType}
+
+// registrationAllowedGrantTypes grant types clients can register themselves with, REGISTRATION_GRANT_TYPES (space separated),
+// the other grant types are set up by the administrator
+func registrationAllowedGrantTypes() database.StringList {
+	if grantTypes := strings.Fields(os.Getenv("REGISTRATION_GRANT_TYPES")); len(grantTypes) > 0 {
+		return grantTypes
+	}
+	return database.StringList{"authorization_code", "refresh_token"}
+}
+
+// registrationAllowedScopes scopes clients can register themselves with, REGISTRATION_SCOPES (space separated)
+func registrationAllowedScopes() database.StringList {
+	if scopes := strings.Fields(os.Getenv("REGISTRATION_SCOPES")); len(scopes) > 0 {
+		return scopes
+	}
+	return standardScopes
+}
+
+// tokenEndpointAuthMethods client authentication methods of the token endpoint
+var tokenEndpointAuthMethods = []string{"client_secret_basic", "client_secret_post", "client_secret_jwt", "private_key_jwt", "tls_client_auth", "self_signed_tls_client_auth", "none"}
+
+// ClientDescription human readable client metadata, stored in Client.Metadata
+type ClientDescription struct {
+	ClientName      string   `json:"client_name,omitempty"`
+	ClientURI       string   `json:"client_uri,omitempty"`
+	LogoURI         string   `json:"logo_uri,omitempty"`
+	Contacts        []string `json:"contacts,omitempty"`
+	TosURI          string   `json:"tos_uri,omitempty"`
+	PolicyURI       string   `json:"policy_uri,omitempty"`
+	SoftwareID      string   `json:"software_id,omitempty"`
+	SoftwareVersion string   `json:"software_version,omitempty"`
+}
+
+// ClientMetadata https://tools.ietf.org/html/rfc7591#section-2
+type ClientMetadata struct {
+	RedirectURIs            []string         `json:"redirect_uris,omitempty"`
+	PostLogoutRedirectURIs  []string         `json:"post_logout_redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string           `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string         `json:"grant_types,omitempty"`
+	ResponseTypes           []string         `json:"response_types,omitempty"`
+	Scope                   string           `json:"scope,omitempty"`
+	JWKSURI                 string           `json:"jwks_uri,omitempty"`
+	JWKS                    database.JSONMap `json:"jwks,omitempty"`
+	// TLSClientAuthSubjectDN https://tools.ietf.org/html/rfc8705#section-2.1.2
+	TLSClientAuthSubjectDN string `json:"tls_client_auth_subject_dn,omitempty"`
+	// TLSClientCertificateThumbprint pins the certificate of self_signed_tls_client_auth clients
+	TLSClientCertificateThumbprint string `json:"tls_client_certificate_thumbprint,omitempty"`
+	// RequirePushedAuthorizationRequests https://datatracker.ietf.org/doc/html/rfc9126#section-6
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests,omitempty"`
+	// RequestURIs https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata
+	RequestURIs []string `json:"request_uris,omitempty"`
+	ClientDescription
+}
+
+// ClientRegistrationRequest body of the registration and the client update request
+type ClientRegistrationRequest struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	ClientMetadata
+}
+
+// ClientRegistrationResponse https://tools.ietf.org/html/rfc7591#section-3.2.1
+type ClientRegistrationResponse struct {
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+	ClientMetadata
+}
+
+// registrationError https://tools.ietf.org/html/rfc7591#section-3.2.2
+type registrationError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *registrationError) Error() string {
+	return e.Description
+}
+
+func invalidClientMetadata(format string, a ...interface{}) error {
+	return &registrationError{Code: "invalid_client_metadata", Description: fmt.Sprintf(format, a...)}
+}
+
+// validate fills in the defaults and checks the metadata is consistent
+func (m *ClientMetadata) validate() error {
+	if len(m.GrantTypes) == 0 {
+		m.GrantTypes = []string{"authorization_code"}
+	}
+	if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+
+	grantTypes := database.StringList(m.GrantTypes)
+	if len(m.ResponseTypes) == 0 {
+		// response types follow the grant types, so clients without redirect based grants need none
+		m.ResponseTypes = []string{}
+		if grantTypes.Contains("authorization_code") {
+			m.ResponseTypes = append(m.ResponseTypes, "code")
+		}
+		if grantTypes.Contains("implicit") {
+			m.ResponseTypes = append(m.ResponseTypes, "token")
+		}
+	}
+	responseTypes := database.StringList(m.ResponseTypes)
+	for _, gt := range grantTypes {
+		if !database.StringList(registrationGrantTypes).Contains(gt) {
+			return invalidClientMetadata("grant type %s is not supported", gt)
+		}
+		if !registrationAllowedGrantTypes().Contains(gt) {
+			return invalidClientMetadata("grant type %s is not allowed for registered clients", gt)
+		}
+	}
+	for _, rt := range responseTypes {
+		switch rt {
+		case "code":
+			if !grantTypes.Contains("authorization_code") {
+				return invalidClientMetadata("response type code requires authorization_code grant type")
+			}
+		case "token":
+			if !grantTypes.Contains("implicit") {
+				return invalidClientMetadata("response type token requires implicit grant type")
+			}
+		default:
+			return invalidClientMetadata("response type %s is not supported", rt)
+		}
+	}
+	if grantTypes.Contains("authorization_code") && !responseTypes.Contains("code") {
+		return invalidClientMetadata("authorization_code grant type requires code response type")
+	}
+	if grantTypes.Contains("implicit") && !responseTypes.Contains("token") {
+		return invalidClientMetadata("implicit grant type requires token response type")
+	}
+	if !database.StringList(tokenEndpointAuthMethods).Contains(m.TokenEndpointAuthMethod) {
+		return invalidClientMetadata("token endpoint auth method %s is not supported", m.TokenEndpointAuthMethod)
+	}
+
+	if len(m.RedirectURIs) == 0 && (grantTypes.Contains("authorization_code") || grantTypes.Contains("implicit")) {
+		return &registrationError{Code: "invalid_redirect_uri", Description: "redirect_uris are required for redirect based grant types"}
+	}
+	if err := validateRedirectURIs(m.RedirectURIs); err != nil {
+		return &registrationError{Code: "invalid_redirect_uri", Description: err.Error()}
+	}
+	if err := validateRedirectURIs(m.PostLogoutRedirectURIs); err != nil {
+		return invalidClientMetadata("invalid post_logout_redirect_uris: %s", err)
+	}
+
+	if m.JWKSURI != "" && m.JWKS != nil {
+		return invalidClientMetadata("jwks and jwks_uri must not be used together")
+	}
+	if m.JWKSURI != "" {
+		u, err := url.Parse(m.JWKSURI)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return invalidClientMetadata("jwks_uri must be https URL")
+		}
+	}
+	for _, uri := range m.RequestURIs {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return invalidClientMetadata("request_uris must be absolute https URIs")
+		}
+	}
+	if m.JWKS != nil {
+		data, err := json.Marshal(m.JWKS)
+		if err == nil {
+			_, err = jwk.Parse(data)
+		}
+		if err != nil {
+			return invalidClientMetadata("invalid jwks: %s", err)
+		}
+	}
+
+	if m.TokenEndpointAuthMethod == "private_key_jwt" && m.JWKSURI == "" && m.JWKS == nil {
+		return invalidClientMetadata("private_key_jwt requires jwks or jwks_uri")
+	}
+	if m.TokenEndpointAuthMethod == "tls_client_auth" && m.TLSClientAuthSubjectDN == "" {
+		return invalidClientMetadata("tls_client_auth requires tls_client_auth_subject_dn")
+	}
+	if m.TokenEndpointAuthMethod == "self_signed_tls_client_auth" && m.TLSClientCertificateThumbprint == "" {
+		return invalidClientMetadata("self_signed_tls_client_auth requires tls_client_certificate_thumbprint")
+	}
+	if key, err := clientSecretKey(); m.TokenEndpointAuthMethod == "client_secret_jwt" && (err != nil || key == nil) {
+		return invalidClientMetadata("client_secret_jwt is not enabled on this server")
+	}
+
+	// clients registering themselves must not get access to the administration API
+	if containsScope(m.Scope, getAdminScope()) {
+		return invalidClientMetadata("scope %s can not be registered", getAdminScope())
+	}
+	for _, scope := range strings.Fields(m.Scope) {
+		if !registrationAllowedScopes().Contains(scope) {
+			return invalidClientMetadata("scope %s is not allowed for registered clients", scope)
+		}
+	}
+	if m.Scope == "" {
+		m.Scope = strings.Join(registrationAllowedScopes(), " ")
+	}
+	return nil
+}
+
+// apply replaces the client attributes with the metadata
+func (m *ClientMetadata) apply(c *Client) error {
+	c.RedirectURIs = m.RedirectURIs
+	c.PostLogoutRedirectURIs = m.PostLogoutRedirectURIs
+	c.TokenEndpointAuthMethod = m.TokenEndpointAuthMethod
+	c.GrantTypes = m.GrantTypes
+	c.ResponseTypes = m.ResponseTypes
+	c.Scopes = strings.Fields(m.Scope)
+	c.JWKSURI = m.JWKSURI
+	c.JWKS = m.JWKS
+	c.TLSClientAuthSubjectDN = m.TLSClientAuthSubjectDN
+	c.TLSClientCertificateThumbprint = m.TLSClientCertificateThumbprint
+	c.RequirePushedAuthorizationRequests = m.RequirePushedAuthorizationRequests
+	c.RequestURIs = m.RequestURIs
+
+	data, err := json.Marshal(m.ClientDescription)
+	if err != nil {
+		return err
+	}
+	c.Metadata = database.JSONMap{}
+	return json.Unmarshal(data, &c.Metadata)
+}
+
+func newClientMetadata(c *Client) (m ClientMetadata) {
+	m = ClientMetadata{
+		RedirectURIs:                       c.RedirectURIs,
+		PostLogoutRedirectURIs:             c.PostLogoutRedirectURIs,
+		TokenEndpointAuthMethod:            c.TokenEndpointAuthMethod,
+		GrantTypes:                         c.GrantTypes,
+		ResponseTypes:                      c.ResponseTypes,
+		Scope:                              strings.Join(c.Scopes, " "),
+		JWKSURI:                            c.JWKSURI,
+		TLSClientAuthSubjectDN:             c.TLSClientAuthSubjectDN,
+		TLSClientCertificateThumbprint:     c.TLSClientCertificateThumbprint,
+		RequirePushedAuthorizationRequests: c.RequirePushedAuthorizationRequests,
+		RequestURIs:                        c.RequestURIs,
+	}
+	if len(c.JWKS) > 0 {
+		m.JWKS = c.JWKS
+	}
+	if data, err := json.Marshal(c.Metadata); err == nil {
+		json.Unmarshal(data, &m.ClientDescription)
+	}
+	return
+}
+
+func newClientRegistrationResponse(r *http.Request, c *Client) *ClientRegistrationResponse {
+	return &ClientRegistrationResponse{
+		ClientID:              c.ID,
+		ClientIDIssuedAt:      c.CreatedAt.Unix(),
+		RegistrationClientURI: getIssuer() + "/register/" + c.ID,
+		ClientMetadata:        newClientMetadata(c),
+	}
+}
+
+// InitialAccessToken authorizes the client registration, only hash of the token is stored
+// https://tools.ietf.org/html/rfc7591#section-3
+type InitialAccessToken struct {
+	TokenHash string `gorm:"primary_key"`
+	ExpiresAt *time.Time
+	CreatedAt time.Time
+}
+
+type InitialAccessTokenStore struct {
+	DB *database.DB
+}
+
+func (s *InitialAccessTokenStore) AutoMigrate() error {
+	return s.DB.AutoMigrate(&InitialAccessToken{})
+}
+
+// Create generates new token, zero expiresIn creates token without expiration
+func (s *InitialAccessTokenStore) Create(expiresIn time.Duration) (token string, t *InitialAccessToken, err error) {
+	token, err = generateSecret()
+	if err != nil {
+		return
+	}
+	t = &InitialAccessToken{TokenHash: hashToken(token)}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		t.ExpiresAt = &expiresAt
+	}
+	err = s.DB.Client().Create(t).Error
+	return
+}
+
+// Valid checks the token exists and is not expired
+func (s *InitialAccessTokenStore) Valid(token string) (bool, error) {
+	var t InitialAccessToken
+	res := s.DB.Client().First(&t, &InitialAccessToken{TokenHash: hashToken(token)})
+	if res.RecordNotFound() {
+		return false, nil
+	}
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return t.ExpiresAt == nil || t.ExpiresAt.After(time.Now()), nil
+}
+
+// hashToken hashes high entropy tokens which are looked up or compared, bcrypt is not needed for them
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// registrationHandler serves the client registration endpoint POST /register
+// and the client configuration endpoint GET, PUT, DELETE /register/{client_id}
+// https://tools.ietf.org/html/rfc7591 https://tools.ietf.org/html/rfc7592
+func registrationHandler(srv *server.Server, clients *ClientStore, tokens *InitialAccessTokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/register"), "/")
+		token, ok := srv.BearerAuth(r)
+		if !ok {
+			writeBearerError(w, http.StatusUnauthorized, "", "")
+			return
+		}
+
+		if clientID == "" {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", "POST")
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			valid, err := tokens.Valid(token)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !valid {
+				writeBearerError(w, http.StatusUnauthorized, "invalid_token", "The initial access token is invalid or expired")
+				return
+			}
+			registerClient(w, r, clients)
+			return
+		}
+
+		client, err := clients.Get(clientID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// unknown clients are not revealed, https://tools.ietf.org/html/rfc7592#section-2
+		if client == nil || client.RegistrationAccessTokenHash == "" ||
+			subtle.ConstantTimeCompare([]byte(client.RegistrationAccessTokenHash), []byte(hashToken(token))) != 1 {
+			writeBearerError(w, http.StatusUnauthorized, "invalid_token", "The registration access token is invalid")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, newClientRegistrationResponse(r, client))
+		case http.MethodPut:
+			updateClientRegistration(w, r, clients, client)
+		case http.MethodDelete:
+			if err := clients.Delete(client.ID); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func registerClient(w http.ResponseWriter, r *http.Request, clients *ClientStore) {
+	var req ClientRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRegistrationError(w, invalidClientMetadata("invalid request body: %s", err))
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+
+	client := &Client{ID: uuid.New().String()}
+	if err := req.apply(client); err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+	secret, err := rotateClientSecret(client)
+	if err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+	registrationToken, err := generateSecret()
+	if err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+	client.RegistrationAccessTokenHash = hashToken(registrationToken)
+
+	if err := clients.Create(client); err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+
+	res := newClientRegistrationResponse(r, client)
+	res.ClientSecret = secret
+	res.RegistrationAccessToken = registrationToken
+	writeJSON(w, http.StatusCreated, res)
+}
+
+// updateClientRegistration replaces the client metadata, the secret is generated only when
+// the client changes from public to confidential
+// https://tools.ietf.org/html/rfc7592#section-2.2
+func updateClientRegistration(w http.ResponseWriter, r *http.Request, clients *ClientStore, client *Client) {
+	var req ClientRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRegistrationError(w, invalidClientMetadata("invalid request body: %s", err))
+		return
+	}
+	if req.ClientID != client.ID {
+		writeRegistrationError(w, invalidClientMetadata("client_id does not match"))
+		return
+	}
+	if req.ClientSecret != "" && !client.VerifySecret(req.ClientSecret) {
+		writeRegistrationError(w, invalidClientMetadata("client_secret does not match"))
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+
+	if err := req.apply(client); err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+	secret := ""
+	if (client.SecretHash != "") != usesClientSecret(client.TokenEndpointAuthMethod) {
+		var err error
+		if secret, err = rotateClientSecret(client); err != nil {
+			writeRegistrationError(w, err)
+			return
+		}
+	}
+	if err := clients.Update(client); err != nil {
+		writeRegistrationError(w, err)
+		return
+	}
+
+	res := newClientRegistrationResponse(r, client)
+	res.ClientSecret = secret
+	writeJSON(w, http.StatusOK, res)
+}
+
+// usesClientSecret checks the auth method needs client secret, public, private_key_jwt and mutual TLS clients have none
+func usesClientSecret(method string) bool {
+	return method != "none" && method != "private_key_jwt" && !usesTLSClientAuth(method)
+}
+
+// rotateClientSecret sets new secret unless the client authenticates without one
+func rotateClientSecret(client *Client) (secret string, err error) {
+	if usesClientSecret(client.TokenEndpointAuthMethod) {
+		if secret, err = generateSecret(); err != nil {
+			return
+		}
+	}
+	err = client.SetSecret(secret)
+	return
+}
+
+func writeRegistrationError(w http.ResponseWriter, err error) {
+	if rerr, ok := err.(*registrationError); ok {
+		writeJSON(w, http.StatusBadRequest, rerr)
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestClientMetadataValidate(t *testing.T) {
+	os.Setenv("REGISTRATION_GRANT_TYPES", strings.Join(registrationGrantTypes, " "))
+	defer os.Unsetenv("REGISTRATION_GRANT_TYPES")
+
+	cases := []struct {
+		name     string
+		metadata ClientMetadata
+		code     string
+	}{
+		{"defaults", ClientMetadata{RedirectURIs: []string{"https://app.example.com/callback"}}, ""},
+		{"missing redirect uri", ClientMetadata{}, "invalid_redirect_uri"},
+		{"relative redirect uri", ClientMetadata{RedirectURIs: []string{"/callback"}}, "invalid_redirect_uri"},
+		{"redirect uri with fragment", ClientMetadata{RedirectURIs: []string{"https://app.example.com/#cb"}}, "invalid_redirect_uri"},
+		{"client credentials only", ClientMetadata{GrantTypes: []string{"client_credentials"}}, ""},
+		{"unsupported grant type", ClientMetadata{GrantTypes: []string{"urn:example"}}, "invalid_client_metadata"},
+		{"inconsistent response type", ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, ResponseTypes: []string{"token"}}, "invalid_client_metadata"},
+		{"implicit", ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, GrantTypes: []string{"implicit"}, ResponseTypes: []string{"token"}}, ""},
+		{"unsupported auth method", ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: "client_secret_magic"}, "invalid_client_metadata"},
+		{"tls_client_auth without subject", ClientMetadata{GrantTypes: []string{"client_credentials"}, TokenEndpointAuthMethod: "tls_client_auth"}, "invalid_client_metadata"},
+		{"tls_client_auth", ClientMetadata{GrantTypes: []string{"client_credentials"}, TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSubjectDN: "CN=svc,O=Example"}, ""},
+		{"jwks and jwks_uri", ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, JWKSURI: "https://app.example.com/jwks", JWKS: map[string]interface{}{"keys": []interface{}{}}}, "invalid_client_metadata"},
+		{"http jwks_uri", ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, JWKSURI: "http://app.example.com/jwks"}, "invalid_client_metadata"},
+		{"private_key_jwt without keys", ClientMetadata{GrantTypes: []string{"client_credentials"}, TokenEndpointAuthMethod: "private_key_jwt"}, "invalid_client_metadata"},
+		{"private_key_jwt", ClientMetadata{GrantTypes: []string{"client_credentials"}, TokenEndpointAuthMethod: "private_key_jwt", JWKSURI: "https://app.example.com/jwks"}, ""},
+		{"http request_uris", ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, RequestURIs: []string{"http://app.example.com/request.jwt"}}, "invalid_client_metadata"},
+		{"relative post_logout_redirect_uris", ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, PostLogoutRedirectURIs: []string{"/signed-out"}}, "invalid_client_metadata"},
+		{"admin scope", ClientMetadata{RedirectURIs: []string{"https://app.example.com/cb"}, Scope: "openid admin"}, "invalid_client_metadata"},
+	}
+	for _, c := range cases {
+		code := ""
+		if err := c.metadata.validate(); err != nil {
+			rerr, ok := err.(*registrationError)
+			if !ok {
+				t.Errorf("[%s] unexpected error %v", c.name, err)
+				continue
+			}
+			code = rerr.Code
+		}
+		if code != c.code {
+			t.Errorf("[%s] expected %q, got %q", c.name, c.code, code)
+		}
+	}
+}
+
+func TestClientMetadataRegistrationPolicy(t *testing.T) {
+	redirectURIs := []string{"https://app.example.com/cb"}
+	cases := []struct {
+		name     string
+		scopes   string
+		metadata ClientMetadata
+		code     string
+	}{
+		{"default grant types", "", ClientMetadata{RedirectURIs: redirectURIs, GrantTypes: []string{"authorization_code", "refresh_token"}}, ""},
+		{"client credentials", "", ClientMetadata{GrantTypes: []string{"client_credentials"}}, "invalid_client_metadata"},
+		{"token exchange", "", ClientMetadata{RedirectURIs: redirectURIs, GrantTypes: []string{"authorization_code", tokenExchangeGrantType}}, "invalid_client_metadata"},
+		{"implicit", "", ClientMetadata{RedirectURIs: redirectURIs, GrantTypes: []string{"implicit"}, ResponseTypes: []string{"token"}}, "invalid_client_metadata"},
+		{"standard scopes", "", ClientMetadata{RedirectURIs: redirectURIs, Scope: "openid email"}, ""},
+		{"custom scope", "", ClientMetadata{RedirectURIs: redirectURIs, Scope: "openid orders:write"}, "invalid_client_metadata"},
+		{"configured custom scope", "openid orders:read", ClientMetadata{RedirectURIs: redirectURIs, Scope: "orders:read"}, ""},
+		{"scope outside configured scopes", "openid orders:read", ClientMetadata{RedirectURIs: redirectURIs, Scope: "email"}, "invalid_client_metadata"},
+	}
+	defer os.Unsetenv("REGISTRATION_SCOPES")
+	for _, c := range cases {
+		os.Setenv("REGISTRATION_SCOPES", c.scopes)
+		code := ""
+		if err := c.metadata.validate(); err != nil {
+			code = err.(*registrationError).Code
+		}
+		if code != c.code {
+			t.Errorf("[%s] expected %q, got %q", c.name, c.code, code)
+		}
+	}
+
+	os.Setenv("REGISTRATION_SCOPES", "openid orders:read")
+	m := ClientMetadata{RedirectURIs: redirectURIs}
+	if err := m.validate(); err != nil || m.Scope != "openid orders:read" {
+		t.Errorf("[%v] empty scope should default to the allowed scopes, got %s", err, m.Scope)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// maxRequestObjectSize limits the request object fetched from request_uri
+const maxRequestObjectSize = 64 << 10
+
+// requestObjectClaims are claims of the JWT itself, they are not authorization request parameters
+var requestObjectClaims = database.StringList{"iss", "aud", "exp", "nbf", "iat", "jti", "sub", "request", "request_uri"}
+
+var requestObjectHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// resolveRequestObject verifies the signed request object passed by value in request or by reference in request_uri
+// and sets its parameters over the ones of the query string
+// https://datatracker.ietf.org/doc/html/rfc9101#section-6
+func resolveRequestObject(r *http.Request, srv *server.Server) error {
+	if r.Form == nil {
+		r.ParseForm()
+	}
+	requestObject, requestURI := r.FormValue("request"), r.FormValue("request_uri")
+	if requestURI != "" && strings.HasPrefix(requestURI, requestURIPrefix) {
+		// pushed requests are resolved by resolvePushedRequest
+		requestURI = ""
+	}
+	if requestObject == "" && requestURI == "" {
+		return nil
+	}
+	if requestObject != "" && requestURI != "" {
+		return ErrInvalidRequestObject
+	}
+
+	cli, err := srv.Manager.GetClient(r.FormValue("client_id"))
+	if err != nil {
+		return err
+	}
+	client, ok := cli.(*Client)
+	if !ok {
+		return ErrInvalidRequestObject
+	}
+	if requestURI != "" {
+		if requestObject, err = fetchRequestObject(client, requestURI); err != nil {
+			log.Println("Request object not fetched:", err)
+			return ErrInvalidRequestURI
+		}
+	}
+
+	claims, err := verifyRequestObject(r, client, requestObject)
+	if err != nil {
+		log.Println("Invalid request object:", err)
+		return ErrInvalidRequestObject
+	}
+	for name, value := range claims {
+		if requestObjectClaims.Contains(name) {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			r.Form.Set(name, v)
+		case json.Number:
+			r.Form.Set(name, v.String())
+		default:
+			// structured parameters like claims are passed on as JSON
+			data, err := json.Marshal(v)
+			if err != nil {
+				return ErrInvalidRequestObject
+			}
+			r.Form.Set(name, string(data))
+		}
+	}
+	r.Form.Del("request")
+	r.Form.Del("request_uri")
+	return nil
+}
+
+// verifyRequestObject checks the request object is signed by the client for this server
+func verifyRequestObject(r *http.Request, client *Client, requestObject string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: clientAssertionSigningAlgs, UseJSONNumber: true}
+	if _, err := parser.ParseWithClaims(requestObject, claims, clientAssertionKeyFunc(client)); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != client.ID {
+		return nil, fmt.Errorf("iss has to be the client_id")
+	}
+	if id, ok := claims["client_id"]; ok && id != client.ID {
+		return nil, fmt.Errorf("client_id does not match the query")
+	}
+	issuer := getIssuer()
+	if issuer == "" {
+		return nil, fmt.Errorf("ISSUER_URL is not configured")
+	}
+	if !assertionAudienceMatches(claims["aud"], issuer) {
+		return nil, fmt.Errorf("request object is not for this server")
+	}
+	// the parser verifies only numeric exp, exp limits how long the object can be replayed
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("request object has no numeric exp")
+	}
+	expiresAt, err := exp.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("request object has no numeric exp")
+	}
+	if time.Until(time.Unix(expiresAt, 0)) > maxAssertionLifetime() {
+		return nil, fmt.Errorf("request object expires too late")
+	}
+	return claims, nil
+}
+
+// fetchRequestObject downloads the request object from request_uri the client registered
+func fetchRequestObject(client *Client, requestURI string) (string, error) {
+	if !client.AllowsRequestURI(requestURI) {
+		return "", fmt.Errorf("request_uri %s is not registered", requestURI)
+	}
+	resp, err := requestObjectHTTPClient.Get(requestURI)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request_uri responded with %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRequestObjectSize))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// requestURIWithoutFragment the fragment of the request_uri may carry hash of the content, it is not registered
+func requestURIWithoutFragment(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graphql-services/oauth/database"
+	"github.com/lestrrat/go-jwx/jwk"
+)
+
+func TestVerifyRequestObject(t *testing.T) {
+	defer os.Unsetenv("ISSUER_URL")
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pk, _ := jwk.New(&key.PublicKey)
+	pk.Set(jwk.KeyIDKey, "app-key")
+	data, _ := json.Marshal(&jwk.Set{Keys: []jwk.Key{pk}})
+	keys := database.JSONMap{}
+	json.Unmarshal(data, &keys)
+	client := &Client{ID: "app", JWKS: keys}
+
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "app-key"
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("[%v] Failed to sign request object", err)
+		}
+		return s
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+
+	cases := []struct {
+		name      string
+		issuerURL string
+		claims    jwt.MapClaims
+		valid     bool
+	}{
+		{"valid", "https://auth.example.com", jwt.MapClaims{"iss": "app", "aud": "https://auth.example.com", "exp": exp, "scope": "openid"}, true},
+		{"string exp", "https://auth.example.com", jwt.MapClaims{"iss": "app", "aud": "https://auth.example.com", "exp": "x"}, false},
+		{"missing exp", "https://auth.example.com", jwt.MapClaims{"iss": "app", "aud": "https://auth.example.com"}, false},
+		{"expired", "https://auth.example.com", jwt.MapClaims{"iss": "app", "aud": "https://auth.example.com", "exp": time.Now().Add(-time.Minute).Unix()}, false},
+		{"exp too late", "https://auth.example.com", jwt.MapClaims{"iss": "app", "aud": "https://auth.example.com", "exp": time.Now().Add(24 * time.Hour).Unix()}, false},
+		{"wrong aud", "https://auth.example.com", jwt.MapClaims{"iss": "app", "aud": "https://other.example.com", "exp": exp}, false},
+		{"aud of request host", "", jwt.MapClaims{"iss": "app", "aud": "http://auth.example.com", "exp": exp}, false},
+		{"wrong iss", "https://auth.example.com", jwt.MapClaims{"iss": "other", "aud": "https://auth.example.com", "exp": exp}, false},
+		{"wrong client_id", "https://auth.example.com", jwt.MapClaims{"iss": "app", "client_id": "other", "aud": "https://auth.example.com", "exp": exp}, false},
+	}
+	for _, c := range cases {
+		os.Setenv("ISSUER_URL", c.issuerURL)
+		r := httptest.NewRequest("GET", "http://auth.example.com/authorize", nil)
+		claims, err := verifyRequestObject(r, client, sign(c.claims))
+		if c.valid && (err != nil || claims["scope"] != "openid") {
+			t.Errorf("[%s] should be valid, got %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("[%s] should be refused", c.name)
+		}
+	}
+}
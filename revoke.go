@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/graphql-services/oauth/database"
+	oauth2gorm "github.com/techknowlogick/go-oauth2-gorm"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/models"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// tokenTableName table of the go-oauth2-gorm token store
+const tokenTableName = "oauth2_token"
+
+// revocationHandler https://tools.ietf.org/html/rfc7009
+func revocationHandler(srv *server.Server, tokenStore oauth2.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		cli, err := authenticateClient(r, srv.Manager)
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+
+		token := r.PostFormValue("token")
+		if token == "" {
+			writeErrorResponse(w, srv, errors.ErrInvalidRequest)
+			return
+		}
+
+		ti, err := findToken(tokenStore, token, r.PostFormValue("token_type_hint"))
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+		if ti != nil {
+			if ti.GetClientID() != cli.GetID() {
+				writeErrorResponse(w, srv, errors.ErrUnauthorizedClient)
+				return
+			}
+			if err := removeToken(tokenStore, ti); err != nil {
+				writeErrorResponse(w, srv, err)
+				return
+			}
+		}
+
+		// invalid tokens do not cause an error response, the client could not handle it anyway
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// findToken looks up access or refresh token regardless of its expiration, hint decides which is tried first
+func findToken(tokenStore oauth2.TokenStore, token, hint string) (ti oauth2.TokenInfo, err error) {
+	lookups := []func(string) (oauth2.TokenInfo, error){tokenStore.GetByAccess, tokenStore.GetByRefresh}
+	if hint == "refresh_token" {
+		lookups = []func(string) (oauth2.TokenInfo, error){tokenStore.GetByRefresh, tokenStore.GetByAccess}
+	}
+	for _, lookup := range lookups {
+		ti, err = lookup(token)
+		if err != nil || ti != nil {
+			return
+		}
+	}
+	return
+}
+
+// removeToken removes the access token together with the refresh token issued with it
+func removeToken(tokenStore oauth2.TokenStore, ti oauth2.TokenInfo) (err error) {
+	if access := ti.GetAccess(); access != "" {
+		if err = tokenStore.RemoveByAccess(access); err != nil {
+			return
+		}
+	}
+	if refresh := ti.GetRefresh(); refresh != "" {
+		err = tokenStore.RemoveByRefresh(refresh)
+	}
+	return
+}
+
+// removeUserTokens deletes tokens of the user issued to the client, or to any client when clientID is empty
+func removeUserTokens(db *database.DB, userID, clientID string) error {
+	return removeStoredTokens(db, `%"UserID":"`+userID+`"%`, func(t models.Token) bool {
+		return t.UserID == userID && (clientID == "" || t.ClientID == clientID)
+	})
+}
+
+// removeClientTokens deletes every token issued to the client
+func removeClientTokens(db *database.DB, clientID string) error {
+	return removeStoredTokens(db, `%"ClientID":"`+clientID+`"%`, func(t models.Token) bool {
+		return t.ClientID == clientID
+	})
+}
+
+// removeStoredTokens deletes the matching tokens, the token store can only look tokens up by their value,
+// so the stored token data is searched with the pattern first
+func removeStoredTokens(db *database.DB, pattern string, match func(models.Token) bool) error {
+	var items []oauth2gorm.StoreItem
+	err := db.Client().Table(tokenTableName).Where("data LIKE ?", pattern).Find(&items).Error
+	if err != nil {
+		return err
+	}
+
+	ids := []uint{}
+	for _, item := range items {
+		var t models.Token
+		if err := json.Unmarshal([]byte(item.Data), &t); err != nil {
+			continue
+		}
+		if match(t) {
+			ids = append(ids, item.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return db.Client().Unscoped().Table(tokenTableName).Where("id IN (?)", ids).Delete(&oauth2gorm.StoreItem{}).Error
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/models"
+	"gopkg.in/oauth2.v3/server"
+	"gopkg.in/oauth2.v3/store"
+)
+
+func TestRevocationHandler(t *testing.T) {
+	db := database.NewDBWithString("sqlite3://:memory:")
+	clients := ClientStore{DB: db}
+	if err := clients.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	for _, id := range []string{"app", "other"} {
+		cli := &Client{ID: id}
+		if err := cli.SetSecret("secret"); err != nil {
+			t.Fatalf("[%v] Failed to set secret", err)
+		}
+		if err := clients.Create(cli); err != nil {
+			t.Fatalf("[%v] Failed to create client", err)
+		}
+	}
+
+	m := manage.NewDefaultManager()
+	m.MapClientStorage(&clients)
+	tokens, _ := store.NewMemoryTokenStore()
+	m.MapTokenStorage(tokens)
+	handler := revocationHandler(server.NewDefaultServer(m), tokens)
+
+	cases := []struct {
+		name       string
+		clientID   string
+		secret     string
+		owner      string
+		hint       string
+		statusCode int
+		revoked    bool
+	}{
+		{"access token", "app", "secret", "app", "", http.StatusOK, true},
+		{"refresh token", "app", "secret", "app", "refresh_token", http.StatusOK, true},
+		{"token of other client", "app", "secret", "other", "", http.StatusUnauthorized, false},
+		{"wrong secret", "app", "wrong", "app", "", http.StatusUnauthorized, false},
+		{"unknown token", "app", "secret", "", "", http.StatusOK, false},
+	}
+	for _, c := range cases {
+		access, refresh := "access-"+c.name, "refresh-"+c.name
+		if c.owner != "" {
+			err := tokens.Create(&models.Token{
+				ClientID:         c.owner,
+				UserID:           "u1",
+				Access:           access,
+				AccessCreateAt:   time.Now(),
+				AccessExpiresIn:  time.Hour,
+				Refresh:          refresh,
+				RefreshCreateAt:  time.Now(),
+				RefreshExpiresIn: time.Hour,
+			})
+			if err != nil {
+				t.Fatalf("[%v] Failed to store token", err)
+			}
+		}
+		token := access
+		if c.hint == "refresh_token" {
+			token = refresh
+		}
+		form := url.Values{"token": {token}, "token_type_hint": {c.hint}}
+		r := httptest.NewRequest("POST", "/revoke", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(c.clientID, c.secret)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.statusCode {
+			t.Errorf("[%s] expected %d, got %d", c.name, c.statusCode, w.Code)
+		}
+		if c.owner == "" {
+			continue
+		}
+		ti, err := tokens.GetByAccess(access)
+		if err != nil {
+			t.Fatalf("[%v] Failed to get token", err)
+		}
+		if (ti == nil) != c.revoked {
+			t.Errorf("[%s] access token revoked: %v", c.name, ti == nil)
+		}
+		if ti, _ := tokens.GetByRefresh(refresh); (ti == nil) != c.revoked {
+			t.Errorf("[%s] refresh token revoked: %v", c.name, ti == nil)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// tokenHandler runs the token request through the server with the checks the library does not cover
+func tokenHandler(srv *server.Server, codes *AuthorizationCodeStore, refreshTokens *RefreshTokenStore, tokenStore oauth2.TokenStore, devices *DeviceCodeStore, clients *ClientStore, jwtBearer *JWTBearerGrant) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setDPoPNonce(w)
+		r, err := withDPoPProof(r)
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+
+		// the library refuses grant types it does not know, so they are handled before its validation
+		switch r.PostFormValue("grant_type") {
+		case deviceCodeGrantType:
+			ti, err := deviceCodeToken(r, srv, devices)
+			if err != nil {
+				writeErrorResponse(w, srv, err)
+				return
+			}
+			writeIssuedToken(w, r, srv, refreshTokens, tokenStore, nil, ti)
+			return
+		case jwtBearerGrantType:
+			ti, err := jwtBearerToken(r, srv, jwtBearer)
+			if err != nil {
+				writeErrorResponse(w, srv, err)
+				return
+			}
+			writeIssuedToken(w, r, srv, refreshTokens, tokenStore, nil, ti)
+			return
+		case tokenExchangeGrantType:
+			ti, err := tokenExchangeToken(r, srv, clients)
+			if err != nil {
+				writeErrorResponse(w, srv, err)
+				return
+			}
+			data := tokenResponseData(srv, ti)
+			// only access tokens are issued, the exchange does not sign the user in
+			delete(data, "id_token")
+			data["issued_token_type"] = accessTokenType
+			writeTokenResponse(w, data)
+			return
+		}
+
+		gt, tgr, err := srv.ValidationTokenRequest(r)
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+
+		if gt == oauth2.AuthorizationCode {
+			req, err := verifyAuthorizationCodeRequest(srv, codes, tgr)
+			if err != nil {
+				writeErrorResponse(w, srv, err)
+				return
+			}
+			// the ID token states how the user signed in for the code
+			if req != nil {
+				r = withAuthentication(r, &Authentication{Nonce: req.Nonce, AuthTime: req.AuthTime, SessionID: req.SessionID, Code: tgr.Code})
+				tgr.Request = r
+			}
+		}
+		var refreshToken *RefreshToken
+		if gt == oauth2.Refreshing {
+			if refreshToken, err = verifyRefreshToken(r, refreshTokens, tokenStore, tgr); err != nil {
+				writeErrorResponse(w, srv, err)
+				return
+			}
+		}
+
+		ti, err := srv.GetAccessToken(gt, tgr)
+		if err != nil {
+			writeErrorResponse(w, srv, err)
+			return
+		}
+
+		if gt == oauth2.AuthorizationCode {
+			codes.Delete(tgr.Code)
+		}
+		writeIssuedToken(w, r, srv, refreshTokens, tokenStore, refreshToken, ti)
+	}
+}
+
+// writeIssuedToken records the refresh token family and writes the token response,
+// the issued tokens are removed again when they can not be recorded
+func writeIssuedToken(w http.ResponseWriter, r *http.Request, srv *server.Server, refreshTokens *RefreshTokenStore, tokenStore oauth2.TokenStore, refreshToken *RefreshToken, ti oauth2.TokenInfo) {
+	if ti.GetRefresh() != "" {
+		sessionID := ""
+		if auth := authenticationFromRequest(r); auth != nil {
+			sessionID = auth.SessionID
+		}
+		if err := refreshTokens.Rotate(refreshToken, ti, bindsRefreshToken(r, srv, ti), sessionID); err != nil {
+			if rerr := removeToken(tokenStore, ti); rerr != nil {
+				log.Println("Failed to remove unrecorded token:", rerr)
+			}
+			if err == ErrRefreshTokenUsed {
+				err = revokeReusedFamily(r, refreshTokens, tokenStore, refreshToken)
+			}
+			writeErrorResponse(w, srv, err)
+			return
+		}
+	}
+	writeTokenResponse(w, tokenResponseData(srv, ti))
+}
+
+// tokenResponseData returns the token response, DPoP bound tokens have the DPoP token type
+func tokenResponseData(srv *server.Server, ti oauth2.TokenInfo) map[string]interface{} {
+	data := srv.GetTokenData(ti)
+	if claims, err := accessTokenClaims(ti); err == nil && claims.Confirmation != nil && claims.Confirmation.JKT != "" {
+		data["token_type"] = "DPoP"
+	}
+	return data
+}
+
+// deviceCodeToken issues the token once the user approved the device
+// https://tools.ietf.org/html/rfc8628#section-3.4
+func deviceCodeToken(r *http.Request, srv *server.Server, devices *DeviceCodeStore) (oauth2.TokenInfo, error) {
+	cli, err := authenticateClient(r, srv.Manager)
+	if err != nil {
+		return nil, err
+	}
+	if !cli.AllowsGrantType(oauth2.GrantType(deviceCodeGrantType)) {
+		return nil, errors.ErrUnauthorizedClient
+	}
+	c, err := verifyDeviceCode(r, devices, cli)
+	if err != nil {
+		return nil, err
+	}
+
+	// the password grant config is used, it issues the refresh token like the other user grants
+	return srv.Manager.GenerateAccessToken(oauth2.PasswordCredentials, &oauth2.TokenGenerateRequest{
+		ClientID:     cli.GetID(),
+		ClientSecret: cli.GetSecret(),
+		UserID:       c.UserID,
+		Scope:        c.Scope,
+		Request:      r,
+	})
+}
+
+// verifyAuthorizationCodeRequest checks code_verifier against the code_challenge stored with the code
+// and returns the stored request, codes issued before the requests were stored have none
+func verifyAuthorizationCodeRequest(srv *server.Server, codes *AuthorizationCodeStore, tgr *oauth2.TokenGenerateRequest) (*AuthorizationCodeRequest, error) {
+	req, err := codes.Get(tgr.Code)
+	if err != nil {
+		return nil, err
+	}
+	verifier := tgr.Request.FormValue("code_verifier")
+
+	if req == nil || req.CodeChallenge == "" {
+		if verifier != "" {
+			return nil, ErrInvalidCodeVerifier
+		}
+		cli, err := srv.Manager.GetClient(tgr.ClientID)
+		if err != nil {
+			return nil, errors.ErrInvalidClient
+		}
+		if client, ok := cli.(*Client); ok && client.RequirePKCE {
+			if req == nil {
+				return nil, errors.ErrInvalidGrant
+			}
+			return nil, ErrInvalidCodeVerifier
+		}
+		return req, nil
+	}
+
+	if !verifyCodeVerifier(req.CodeChallenge, req.CodeChallengeMethod, verifier) {
+		return nil, ErrInvalidCodeVerifier
+	}
+	return req, nil
+}
+
+// verifyRefreshToken detects reuse of rotated refresh tokens, which revokes the whole family, and checks the absolute lifetime.
+// The token is marked as used by Rotate once the new one is issued, so failed refreshes can be retried.
+// Tokens issued before the families were recorded start new family.
+func verifyRefreshToken(r *http.Request, refreshTokens *RefreshTokenStore, tokenStore oauth2.TokenStore, tgr *oauth2.TokenGenerateRequest) (*RefreshToken, error) {
+	rt, err := refreshTokens.Get(tgr.Refresh)
+	if err != nil || rt == nil {
+		return nil, err
+	}
+	// tokens presented by other clients are refused by the manager without touching the family
+	if rt.ClientID != tgr.ClientID {
+		return rt, nil
+	}
+
+	if rt.DPoPJKT != "" && rt.DPoPJKT != dpopKeyFromRequest(r) {
+		return nil, ErrInvalidDPoPProof
+	}
+	if rt.UsedAt != nil {
+		return nil, revokeReusedFamily(r, refreshTokens, tokenStore, rt)
+	}
+
+	if lifetime := refreshTokenAbsoluteLifetime(); lifetime > 0 && time.Since(rt.FamilyCreatedAt) > lifetime {
+		if err := refreshTokens.RevokeFamily(rt.FamilyID, tokenStore); err != nil {
+			return nil, err
+		}
+		return nil, errors.ErrInvalidGrant
+	}
+	return rt, nil
+}
+
+// revokeReusedFamily revokes the family of the refresh token presented again after it was rotated,
+// the token could have been stolen, so every token of the family is revoked
+func revokeReusedFamily(r *http.Request, refreshTokens *RefreshTokenStore, tokenStore oauth2.TokenStore, rt *RefreshToken) error {
+	securityEvent(r.Context(), "refresh_token_reuse", map[string]string{
+		"client_id": rt.ClientID,
+		"user_id":   rt.UserID,
+		"family_id": rt.FamilyID,
+	})
+	if err := refreshTokens.RevokeFamily(rt.FamilyID, tokenStore); err != nil {
+		return err
+	}
+	return errors.ErrInvalidGrant
+}
+
+func writeTokenResponse(w http.ResponseWriter, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
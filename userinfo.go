@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"gopkg.in/oauth2.v3/server"
+)
+
+// UserInfo claims returned from the UserInfo endpoint
+// https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+type UserInfo struct {
+	Subject string `json:"sub"`
+	IDTokenUserClaims
+}
+
+func userInfoHandler(srv *server.Server, us *UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		span, ctx := opentracing.StartSpanFromContext(context.Background(), "oauth - /userinfo")
+		defer span.Finish()
+
+		ti, ok := validateBearerToken(w, r, srv)
+		if !ok {
+			return
+		}
+		scope := ti.GetScope()
+		if !containsScope(scope, "openid") {
+			writeBearerError(w, http.StatusForbidden, "insufficient_scope", "The access token was not granted the openid scope", "openid")
+			return
+		}
+		if ti.GetUserID() == "" {
+			writeBearerError(w, http.StatusUnauthorized, "invalid_token", "The access token was not issued to a user")
+			return
+		}
+
+		user, err := us.GetUser(ctx, ti.GetUserID())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			writeBearerError(w, http.StatusUnauthorized, "invalid_token", "The user of the access token no longer exists")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(UserInfo{
+			Subject:           user.ID,
+			IDTokenUserClaims: newIDTokenUserClaims(user, scope),
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/graphql-services/oauth/database"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/manage"
+	"gopkg.in/oauth2.v3/models"
+	"gopkg.in/oauth2.v3/server"
+	"gopkg.in/oauth2.v3/store"
+)
+
+// createTestAccessToken stores the token with a JWT access token signed like the issued ones, needs useTestSigningKey
+func createTestAccessToken(t *testing.T, tokens oauth2.TokenStore, ti *models.Token, claims *JWTAccessClaims) string {
+	if ti.AccessCreateAt.IsZero() {
+		ti.AccessCreateAt = time.Now()
+	}
+	if ti.AccessExpiresIn == 0 {
+		ti.AccessExpiresIn = time.Hour
+	}
+	if claims == nil {
+		claims = &JWTAccessClaims{}
+	}
+	claims.Audience = ti.ClientID
+	// like the generator, tokens without user are issued to the client itself
+	claims.Subject = ti.UserID
+	if ti.UserID == "" {
+		claims.Subject = ti.ClientID
+	}
+	claims.Id = uuid.New().String()
+	claims.Scope = ti.Scope
+	claims.ExpiresAt = ti.AccessCreateAt.Add(ti.AccessExpiresIn).Unix()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["typ"] = accessTokenJWTType
+	access, err := signToken(token)
+	if err != nil {
+		t.Fatalf("[%v] Failed to sign access token", err)
+	}
+	ti.Access = access
+	if err := tokens.Create(ti); err != nil {
+		t.Fatalf("[%v] Failed to store access token", err)
+	}
+	return access
+}
+
+func TestUserInfoHandler(t *testing.T) {
+	defer useTestSigningKey(t)()
+
+	id := newTestIDServer()
+	defer id.Close()
+	users := UserStore{DB: database.NewDBWithString("sqlite3://:memory:"), ID: &IDClient{URL: id.URL}}
+	if err := users.AutoMigrate(); err != nil {
+		t.Fatalf("[%v] Failed to automigrate", err)
+	}
+	user, err := users.CreateUserWithAccount(context.Background(), "abcd1234", "john.doe@example.com", "facebook")
+	if err != nil {
+		t.Fatalf("[%v] Failed to create user", err)
+	}
+
+	m := manage.NewDefaultManager()
+	tokens, _ := store.NewMemoryTokenStore()
+	m.MapTokenStorage(tokens)
+	handler := userInfoHandler(server.NewDefaultServer(m), &users)
+
+	cases := []struct {
+		name       string
+		userID     string
+		scope      string
+		statusCode int
+	}{
+		{"missing token", "", "", http.StatusUnauthorized},
+		{"without openid scope", user.ID, "email", http.StatusForbidden},
+		{"client credentials", "", "openid email", http.StatusUnauthorized},
+		{"deleted user", "deleted", "openid email", http.StatusUnauthorized},
+		{"user", user.ID, "openid email", http.StatusOK},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/userinfo", nil)
+		if c.scope != "" {
+			access := createTestAccessToken(t, tokens, &models.Token{ClientID: "app", UserID: c.userID, Scope: c.scope}, nil)
+			r.Header.Set("Authorization", "Bearer "+access)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.statusCode {
+			t.Errorf("[%s] expected %d, got %d", c.name, c.statusCode, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var info map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&info)
+		if info["sub"] != user.ID || info["email"] != "john.doe@example.com" {
+			t.Errorf("[%s] unexpected claims %v", c.name, info)
+		}
+		if _, ok := info["name"]; ok {
+			t.Errorf("[%s] profile claims should need the profile scope, got %v", c.name, info)
+		}
+	}
+}
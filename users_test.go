@@ -2,25 +2,55 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/google/uuid"
 	"github.com/graphql-services/oauth/database"
 )
 
+// newTestIDServer fakes the ID service user query and invitation mutation
+func newTestIDServer() *httptest.Server {
+	users := map[string]*User{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query     string
+			Variables map[string]string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		var u *User
+		if strings.Contains(req.Query, "inviteUser") {
+			u = &User{ID: uuid.New().String(), Email: req.Variables["email"]}
+			users[u.ID] = u
+		} else {
+			u = users[req.Variables["id"]]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": IDResponse{Result: u}})
+	}))
+}
+
 func TestUserStore(t *testing.T) {
 	db := database.NewDBWithString("sqlite3://:memory:")
+	id := newTestIDServer()
+	defer id.Close()
 
-	s := UserStore{db}
+	s := UserStore{DB: db, ID: &IDClient{URL: id.URL}}
 
-	if err := s.Automigrate(); err != nil {
+	if err := s.AutoMigrate(); err != nil {
 		t.Errorf("[%v] Failed to automigrate", err.Error())
 	}
 
+	ctx := context.Background()
 	accountType := "facebook"
 	accountID := "abcd1234"
 	email := "john.doe@example.com"
 
-	u, err := s.GetUserByAccount(accountID, accountType)
+	u, err := s.GetUserByAccount(ctx, accountID, accountType)
 	if err != nil {
 		t.Errorf("[%v] Failed to get user by account", err.Error())
 	}
@@ -28,15 +58,15 @@ func TestUserStore(t *testing.T) {
 		t.Errorf("[%v] user should be nil, but found", u.ID)
 	}
 
-	u, err = s.CreateUserWithAccount(accountID, email, accountType)
+	u, err = s.CreateUserWithAccount(ctx, accountID, email, accountType)
 	if err != nil {
 		t.Errorf("[%v] Failed to create user", err.Error())
 	}
 	if u == nil {
-		t.Errorf("[%v] user should not be nil", u.ID)
+		t.Fatalf("user should not be nil")
 	}
 
-	u2, err := s.GetOrCreateUserWithAccount(accountID, email, accountType)
+	u2, err := s.GetOrCreateUserWithAccount(ctx, accountID, email, accountType)
 	if err != nil {
 		t.Errorf("[%v] Failed to get or create user", err.Error())
 	}